@@ -0,0 +1,86 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"time"
+)
+
+// AccessEntry describes one proxied request.
+type AccessEntry struct {
+	Client    string // client remote addr
+	Target    string // requested host:port, hostname kept for domain requests
+	Upstream  string // exit proxy addr, "direct", or empty if none was available
+	Start     time.Time
+	BytesUp   int64 // client -> target
+	BytesDown int64 // target -> client
+	Err       error // nil on success
+}
+
+// AccessLog writes one key=value line per request. A nil *AccessLog
+// is valid and discards everything, so callers needn't check.
+type AccessLog struct {
+	logger *log.Logger
+	file   *os.File
+}
+
+// OpenAccessLog logs to stderr for "-", otherwise appends to path.
+func OpenAccessLog(path string) (*AccessLog, error) {
+	var w io.Writer = os.Stderr
+	var f *os.File
+	if path != "-" {
+		var err error
+		f, err = os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o644)
+		if err != nil {
+			return nil, err
+		}
+		w = f
+	}
+	return &AccessLog{logger: log.New(w, "", log.LstdFlags), file: f}, nil
+}
+
+// Log writes e as a single line.
+func (a *AccessLog) Log(e AccessEntry) {
+	if a == nil {
+		return
+	}
+	status := "ok"
+	if e.Err != nil {
+		status = "fail"
+	}
+	line := fmt.Sprintf("[access] client=%s target=%s upstream=%s status=%s up=%d down=%d duration=%s",
+		orDash(e.Client), e.Target, orDash(e.Upstream), status, e.BytesUp, e.BytesDown,
+		time.Since(e.Start).Round(time.Millisecond))
+	if e.Err != nil {
+		line += fmt.Sprintf(" error=%q", e.Err.Error())
+	}
+	a.logger.Print(line)
+}
+
+// Close closes the log file, if any.
+func (a *AccessLog) Close() error {
+	if a == nil || a.file == nil {
+		return nil
+	}
+	return a.file.Close()
+}
+
+// upstreamLabel names the upstream a request used for the log.
+func upstreamLabel(px Proxy) string {
+	switch {
+	case px.Scheme == directUpstream.Scheme:
+		return "direct"
+	case px.IP == "":
+		return ""
+	}
+	return px.Addr()
+}
+
+func orDash(s string) string {
+	if s == "" {
+		return "-"
+	}
+	return s
+}
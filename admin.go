@@ -0,0 +1,173 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// AdminServer is the -admin-socket control surface, for headless hosts
+// that don't expose the dashboard. It speaks a line protocol on a Unix
+// socket, so socat or nc can script it:
+//
+//	list          one proxy per line: index, proxy, country, latency, flags
+//	switch [N]    switch to proxy N, the next one, or "fastest"
+//	refresh       trigger a pool refresh
+//	stats         pool and traffic counters, one "key value" per line
+//	quit          close the connection
+//
+// Each response ends with an empty line. Anyone who can open the
+// socket controls the pool, so it's created mode 0600 from the start.
+type AdminServer struct {
+	pool   *ProxyPool
+	server *Server
+	ln     net.Listener
+}
+
+// ListenAdmin binds the admin socket at path. A stale socket left by an
+// earlier run is replaced; a live one, or any other file, is an error.
+func ListenAdmin(path string, pool *ProxyPool, server *Server) (*AdminServer, error) {
+	if fi, err := os.Lstat(path); err == nil {
+		if fi.Mode()&os.ModeSocket == 0 {
+			return nil, fmt.Errorf("%s exists and is not a socket", path)
+		}
+		if conn, err := net.DialTimeout("unix", path, time.Second); err == nil {
+			conn.Close()
+			return nil, fmt.Errorf("%s is in use by another process", path)
+		}
+		os.Remove(path)
+	}
+	ln, err := listenPrivate(path)
+	if err != nil {
+		return nil, err
+	}
+	// Already 0600 from the umask where there is one; make sure anyway
+	if err := os.Chmod(path, 0o600); err != nil {
+		ln.Close()
+		return nil, err
+	}
+	return &AdminServer{pool: pool, server: server, ln: ln}, nil
+}
+
+// Serve accepts connections until Close.
+func (a *AdminServer) Serve() {
+	for {
+		conn, err := a.ln.Accept()
+		if err != nil {
+			if !errors.Is(err, net.ErrClosed) {
+				warnf("[admin] accept: %v", err)
+			}
+			return
+		}
+		go a.handle(conn)
+	}
+}
+
+// Close stops accepting and removes the socket file.
+func (a *AdminServer) Close() error {
+	return a.ln.Close()
+}
+
+func (a *AdminServer) handle(conn net.Conn) {
+	defer conn.Close()
+	sc := bufio.NewScanner(conn)
+	w := bufio.NewWriter(conn)
+	for sc.Scan() {
+		cmd, arg, _ := strings.Cut(strings.TrimSpace(sc.Text()), " ")
+		arg = strings.TrimSpace(arg)
+		if cmd == "" {
+			continue
+		}
+		if cmd == "quit" {
+			return
+		}
+		debugf("[admin] %s %s", cmd, arg)
+		a.exec(w, cmd, arg)
+		fmt.Fprintln(w)
+		if w.Flush() != nil {
+			return
+		}
+	}
+}
+
+// exec runs one command, writing its response to w. Failures are a
+// single "error: ..." line, successes without output "ok".
+func (a *AdminServer) exec(w *bufio.Writer, cmd, arg string) {
+	switch cmd {
+	case "list":
+		pinned := a.pool.Pinned()
+		current := a.pool.CurrentIndex()
+		for i, px := range a.pool.All() {
+			var flags []string
+			if i == current {
+				flags = append(flags, "active")
+			}
+			if pinned[px.Addr()] {
+				flags = append(flags, "pinned")
+			}
+			fmt.Fprintf(w, "%d\t%s\t%s\t%dms\t%s\n", i, px, orDash(px.CountryCode),
+				px.Latency.Milliseconds(), strings.Join(flags, ","))
+		}
+
+	case "switch":
+		var ok bool
+		switch arg {
+		case "":
+			_, ok = a.pool.SwitchNext()
+		case "fastest":
+			_, ok = a.pool.SwitchToFastest()
+		default:
+			index, err := strconv.Atoi(arg)
+			if err != nil {
+				fmt.Fprintf(w, "error: invalid index %q\n", arg)
+				return
+			}
+			if _, ok = a.pool.SwitchTo(index); !ok {
+				fmt.Fprintln(w, "error: index out of range")
+				return
+			}
+		}
+		if !ok {
+			fmt.Fprintln(w, "error: no proxies available")
+			return
+		}
+		px, _ := a.pool.Current()
+		fmt.Fprintf(w, "ok %s\n", px)
+
+	case "refresh":
+		TriggerRefresh()
+		fmt.Fprintln(w, "ok refresh triggered")
+
+	case "stats":
+		served, up, down := a.server.Traffic()
+		active := "-"
+		if px, ok := a.pool.Current(); ok {
+			active = px.String()
+		}
+		last, next := getScrapeTimes()
+		fmt.Fprintf(w, "proxies %d\n", a.pool.Size())
+		fmt.Fprintf(w, "active %s\n", active)
+		fmt.Fprintf(w, "conns %d\n", a.server.ActiveConns())
+		fmt.Fprintf(w, "served %d\n", served)
+		fmt.Fprintf(w, "bytes_up %d\n", up)
+		fmt.Fprintf(w, "bytes_down %d\n", down)
+		fmt.Fprintf(w, "last_scrape %s\n", formatScrapeTime(last))
+		fmt.Fprintf(w, "next_scrape %s\n", formatScrapeTime(next))
+
+	default:
+		fmt.Fprintf(w, "error: unknown command %q (list, switch [N], refresh, stats, quit)\n", cmd)
+	}
+}
+
+// formatScrapeTime is t in RFC 3339, or "-" before the first scrape.
+func formatScrapeTime(t time.Time) string {
+	if t.IsZero() {
+		return "-"
+	}
+	return t.Format(time.RFC3339)
+}
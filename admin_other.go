@@ -0,0 +1,11 @@
+//go:build !unix
+
+package main
+
+import "net"
+
+// listenPrivate binds a Unix socket at path. There's no umask here, so
+// ListenAdmin's chmod is the only restriction.
+func listenPrivate(path string) (net.Listener, error) {
+	return net.Listen("unix", path)
+}
@@ -0,0 +1,18 @@
+//go:build unix
+
+package main
+
+import (
+	"net"
+	"syscall"
+)
+
+// listenPrivate binds a Unix socket at path that only the owner can
+// connect to. The umask covers the window between bind and chmod, in
+// which the socket would otherwise be open to anyone; it's process-wide,
+// so this runs at startup before other files are created.
+func listenPrivate(path string) (net.Listener, error) {
+	old := syscall.Umask(0o177)
+	defer syscall.Umask(old)
+	return net.Listen("unix", path)
+}
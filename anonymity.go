@@ -0,0 +1,143 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// DefaultAnonymityURL is the echo service used when -anonymity-url is
+// unset. Any endpoint returning httpbin's /get JSON shape works.
+const DefaultAnonymityURL = "http://httpbin.org/get"
+
+// Anonymity classifies what a proxy reveals to the destination.
+type Anonymity string
+
+const (
+	AnonUnknown     Anonymity = ""            // not checked
+	AnonTransparent Anonymity = "transparent" // leaks the client's real IP
+	AnonAnonymous   Anonymity = "anonymous"   // hides the IP but admits to proxying
+	AnonElite       Anonymity = "elite"       // indistinguishable from a direct client
+)
+
+// proxyHeaders announce that a request went through a proxy.
+var proxyHeaders = []string{
+	"Via", "X-Forwarded-For", "Forwarded", "X-Real-Ip",
+	"X-Proxy-Id", "Proxy-Connection", "X-Forwarded-Host", "Client-Ip",
+}
+
+// echoResponse is the part of httpbin's /get response we inspect.
+type echoResponse struct {
+	Headers map[string]string `json:"headers"`
+	Origin  string            `json:"origin"`
+}
+
+// lookupRealIP asks the echo service for our own address, directly.
+func lookupRealIP(ctx context.Context, target, path string, timeout time.Duration) (string, error) {
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, "http://"+target+path, nil)
+	if err != nil {
+		return "", err
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	var echo echoResponse
+	if err := json.NewDecoder(io.LimitReader(resp.Body, 64<<10)).Decode(&echo); err != nil {
+		return "", err
+	}
+	// origin may be a list when we're behind a proxy ourselves
+	ip, _, _ := strings.Cut(echo.Origin, ",")
+	if ip = strings.TrimSpace(ip); ip == "" {
+		return "", fmt.Errorf("echo response has no origin")
+	}
+	return ip, nil
+}
+
+// checkAnonymity fetches the echo service through p and classifies it
+// by whether realIP or any proxy header reaches the destination.
+func checkAnonymity(ctx context.Context, p Proxy, target, path, realIP string, timeout time.Duration) (Anonymity, error) {
+	conn, err := dialVia(ctx, p, target, timeout)
+	if err != nil {
+		return AnonUnknown, err
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(timeout))
+	defer context.AfterFunc(ctx, func() { conn.SetDeadline(time.Unix(1, 0)) })()
+
+	host := target
+	if h, port, err := net.SplitHostPort(target); err == nil && port == "80" {
+		host = h
+	}
+	req := fmt.Sprintf("GET %s HTTP/1.1\r\nHost: %s\r\nConnection: close\r\n\r\n", path, host)
+	if _, err := conn.Write([]byte(req)); err != nil {
+		return AnonUnknown, err
+	}
+	resp, err := http.ReadResponse(bufio.NewReader(conn), nil)
+	if err != nil {
+		return AnonUnknown, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return AnonUnknown, fmt.Errorf("echo status %d", resp.StatusCode)
+	}
+	var echo echoResponse
+	if err := json.NewDecoder(io.LimitReader(resp.Body, 64<<10)).Decode(&echo); err != nil {
+		return AnonUnknown, err
+	}
+	return classifyEcho(echo, realIP), nil
+}
+
+func classifyEcho(echo echoResponse, realIP string) Anonymity {
+	if ip := net.ParseIP(realIP); ip != nil {
+		if listsIP(echo.Origin, ip) {
+			return AnonTransparent
+		}
+		for _, v := range echo.Headers {
+			if listsIP(v, ip) {
+				return AnonTransparent
+			}
+		}
+	}
+	for name := range echo.Headers {
+		for _, h := range proxyHeaders {
+			if strings.EqualFold(name, h) {
+				return AnonAnonymous
+			}
+		}
+	}
+	return AnonElite
+}
+
+// listsIP reports whether ip is one of the addresses in v, a
+// comma-separated list as in Origin or X-Forwarded-For. RFC 7239
+// Forwarded elements are read from their for= parameter. Addresses are
+// compared exactly, so 1.2.3.4 doesn't match 11.2.3.45.
+func listsIP(v string, ip net.IP) bool {
+	for _, tok := range strings.FieldsFunc(v, func(r rune) bool { return r == ',' || r == ';' }) {
+		tok = strings.TrimSpace(tok)
+		if key, val, ok := strings.Cut(tok, "="); ok {
+			if !strings.EqualFold(strings.TrimSpace(key), "for") {
+				continue
+			}
+			tok = strings.Trim(strings.TrimSpace(val), `"`)
+			if host, _, err := net.SplitHostPort(tok); err == nil {
+				tok = host
+			}
+			tok = strings.Trim(tok, "[]")
+		}
+		if got := net.ParseIP(tok); got != nil && got.Equal(ip) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,32 @@
+package main
+
+import "testing"
+
+func TestClassifyEcho(t *testing.T) {
+	tests := []struct {
+		name    string
+		origin  string
+		headers map[string]string
+		realIP  string
+		want    Anonymity
+	}{
+		{"origin is real ip", "1.2.3.4", nil, "1.2.3.4", AnonTransparent},
+		{"origin lists real ip", "5.6.7.8, 1.2.3.4", nil, "1.2.3.4", AnonTransparent},
+		{"origin contains real ip as substring", "11.2.3.45", nil, "1.2.3.4", AnonElite},
+		{"forwarded-for lists real ip", "5.6.7.8", map[string]string{"X-Forwarded-For": "1.2.3.4 , 9.9.9.9"}, "1.2.3.4", AnonTransparent},
+		{"forwarded-for substring", "5.6.7.8", map[string]string{"X-Forwarded-For": "21.2.3.4"}, "1.2.3.4", AnonAnonymous},
+		{"ipv6 different spelling", "5.6.7.8", map[string]string{"X-Real-Ip": "2001:DB8:0::1"}, "2001:db8::1", AnonTransparent},
+		{"rfc 7239 forwarded", "5.6.7.8", map[string]string{"Forwarded": `for="[2001:db8::1]:4711";proto=http`}, "2001:db8::1", AnonTransparent},
+		{"rfc 7239 forwarded other ip", "5.6.7.8", map[string]string{"Forwarded": "for=9.9.9.9;by=1.2.3.4"}, "1.2.3.4", AnonAnonymous},
+		{"unrelated header", "5.6.7.8", map[string]string{"User-Agent": "agent/1.2.3.4"}, "1.2.3.4", AnonElite},
+		{"no proxy headers", "5.6.7.8", map[string]string{"Accept": "*/*"}, "1.2.3.4", AnonElite},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := classifyEcho(echoResponse{Origin: tt.origin, Headers: tt.headers}, tt.realIP)
+			if got != tt.want {
+				t.Errorf("classifyEcho = %v; want %v", got, tt.want)
+			}
+		})
+	}
+}
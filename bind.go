@@ -0,0 +1,168 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+	"time"
+)
+
+// bindAcceptTimeout is how long a BIND waits for the peer to connect
+// to the address the upstream opened, e.g. an FTP server's data
+// connection.
+const bindAcceptTimeout = 2 * time.Minute
+
+// handleBind serves a BIND request, as used by active FTP. The upstream
+// listens on our behalf; the client gets its listening address in a
+// first reply and the peer's address in a second one once the peer has
+// connected, then the two are relayed. This is best-effort: only SOCKS5
+// upstreams can BIND and many don't support it, so a refusal moves on
+// to the next upstream without counting against the proxy.
+func (s *Server) handleBind(conn net.Conn, target string) {
+	entry := AccessEntry{Client: conn.RemoteAddr().String(), Target: target, Start: time.Now()}
+	var (
+		ctrl     net.Conn
+		bound    string
+		upstream Proxy
+	)
+	evicted := false
+	tried := make(map[string]bool)
+	for i := 0; i < s.retries; i++ {
+		px, ok := s.pickUntried(clientIP(conn), i, evicted, tried)
+		if !ok && i == 0 {
+			warnf("[bind] no proxies available")
+		}
+		if !ok {
+			break
+		}
+		upstream = px
+		tried[upstream.Addr()] = true
+		if upstream.scheme() != SchemeSOCKS5 {
+			// HTTP CONNECT has no BIND; not the proxy's fault
+			s.pool.Release(upstream.Addr())
+			evicted = false
+			continue
+		}
+
+		var err error
+		ctrl, bound, err = bindViaSOCKS5(upstream, target, s.dialTimeout)
+		if err != nil {
+			warnf("[bind] upstream %s bind failed: %v, switching...", upstream.Addr(), err)
+			s.pool.Release(upstream.Addr())
+			var refused *replyError
+			evicted = !errors.As(err, &refused) && s.pool.MarkFailure(upstream.Addr(), err)
+			continue
+		}
+		s.pool.MarkSuccess(upstream.Addr())
+		defer s.pool.Release(upstream.Addr())
+		break
+	}
+	entry.Upstream = upstreamLabel(upstream)
+	if ctrl == nil {
+		s.sendReply(conn, replyGeneralFailure)
+		entry.Err = fmt.Errorf("no upstream could bind for %s", target)
+		s.AccessLog.Log(entry)
+		return
+	}
+	defer ctrl.Close()
+
+	// First reply: where the peer should connect
+	if err := s.sendReplyHostPort(conn, bound); err != nil {
+		s.sendReply(conn, replyGeneralFailure)
+		entry.Err = err
+		s.AccessLog.Log(entry)
+		return
+	}
+
+	// Second reply: who connected
+	ctrl.SetReadDeadline(time.Now().Add(bindAcceptTimeout))
+	reply, err := readSOCKS5Msg(ctrl)
+	if err == nil && reply[1] != 0x00 {
+		err = &replyError{cmd: "bind", code: reply[1]}
+	}
+	if err != nil {
+		s.sendReply(conn, replyCode(err))
+		entry.Err = fmt.Errorf("waiting for bind peer: %w", err)
+		s.AccessLog.Log(entry)
+		return
+	}
+	ctrl.SetReadDeadline(time.Time{})
+	peer, err := parseTarget(reply)
+	if err == nil {
+		err = s.sendReplyHostPort(conn, peer)
+	}
+	if err != nil {
+		s.sendReply(conn, replyGeneralFailure)
+		entry.Err = err
+		s.AccessLog.Log(entry)
+		return
+	}
+	debugf("[bind] %s accepted %s via %s", conn.RemoteAddr(), peer, upstream.Addr())
+
+	entry.BytesUp, entry.BytesDown = relay(conn, ctrl, s.idleTimeout, s.relayBufs)
+	s.addTraffic(entry.BytesUp, entry.BytesDown)
+	s.AccessLog.Log(entry)
+}
+
+// bindViaSOCKS5 asks upstream to listen for a connection from target
+// and returns the control connection, which carries the second reply
+// and then the relayed data, and the address the upstream listens on.
+// An unspecified bound address means the proxy's own IP.
+func bindViaSOCKS5(upstream Proxy, target string, timeout time.Duration) (net.Conn, string, error) {
+	conn, err := dialProxy(context.Background(), upstream, timeout)
+	if err != nil {
+		return nil, "", err
+	}
+	conn.SetDeadline(time.Now().Add(timeout))
+
+	if err := socks5Handshake(conn, upstream); err != nil {
+		conn.Close()
+		return nil, "", err
+	}
+	req, err := socks5Request(cmdBind, target)
+	if err != nil {
+		conn.Close()
+		return nil, "", err
+	}
+	conn.Write(req)
+
+	reply, err := readSOCKS5Msg(conn)
+	if err != nil {
+		conn.Close()
+		return nil, "", err
+	}
+	if reply[1] != 0x00 {
+		conn.Close()
+		return nil, "", &replyError{cmd: "bind", code: reply[1]}
+	}
+	bound, err := parseTarget(reply)
+	if err != nil {
+		conn.Close()
+		return nil, "", err
+	}
+	host, port, _ := net.SplitHostPort(bound)
+	if ip := net.ParseIP(host); ip != nil && ip.IsUnspecified() {
+		bound = net.JoinHostPort(upstream.IP, port)
+	}
+
+	conn.SetDeadline(time.Time{})
+	return conn, bound, nil
+}
+
+// sendReplyHostPort writes a success reply with addr (IP:port) as
+// BND.ADDR/BND.PORT.
+func (s *Server) sendReplyHostPort(conn net.Conn, addr string) error {
+	host, portStr, err := net.SplitHostPort(addr)
+	if err != nil {
+		return err
+	}
+	ip := net.ParseIP(host)
+	port, err := strconv.Atoi(portStr)
+	if ip == nil || err != nil {
+		return fmt.Errorf("bind address %q is not IP:port", addr)
+	}
+	s.sendReplyAddr(conn, 0x00, ip, port)
+	return nil
+}
@@ -0,0 +1,77 @@
+package main
+
+import "time"
+
+// Circuit breaker states, as shown on the dashboard.
+const (
+	BreakerClosed   = "closed"    // in normal use
+	BreakerOpen     = "open"      // skipped until the cooldown ends
+	BreakerHalfOpen = "half-open" // one trial connection decides
+)
+
+// breakerLocked returns addr's breaker state. Caller holds p.mu.
+func (p *ProxyPool) breakerLocked(addr string, now time.Time) string {
+	until, ok := p.openUntil[addr]
+	switch {
+	case !ok:
+		return BreakerClosed
+	case now.Before(until):
+		return BreakerOpen
+	default:
+		return BreakerHalfOpen
+	}
+}
+
+// usableLocked reports whether addr may take a connection: its breaker
+// is closed, or half-open with no trial running yet. Caller holds p.mu.
+func (p *ProxyPool) usableLocked(addr string, now time.Time) bool {
+	switch p.breakerLocked(addr, now) {
+	case BreakerClosed:
+		return true
+	case BreakerHalfOpen:
+		return !p.trial[addr]
+	}
+	return false
+}
+
+// claimLocked marks a half-open proxy's trial as taken. Caller holds p.mu.
+func (p *ProxyPool) claimLocked(addr string, now time.Time) {
+	if p.breakerLocked(addr, now) == BreakerHalfOpen {
+		p.trial[addr] = true
+	}
+}
+
+// tripLocked opens addr's breaker once it has -breaker-failures
+// consecutive failures; a failed trial re-opens it the same way.
+// Caller holds p.mu.
+func (p *ProxyPool) tripLocked(addr string) {
+	if p.breakerFailures <= 0 || p.failures[addr] < p.breakerFailures {
+		return
+	}
+	p.openUntil[addr] = time.Now().Add(p.breakerCooldown)
+	delete(p.trial, addr)
+	infof("[pool] circuit open for %s after %d failures, retrying in %s", addr, p.failures[addr], p.breakerCooldown)
+	p.notify()
+}
+
+// resetLocked closes addr's breaker after a success. Caller holds p.mu.
+func (p *ProxyPool) resetLocked(addr string) {
+	if _, ok := p.openUntil[addr]; ok {
+		delete(p.openUntil, addr)
+		delete(p.trial, addr)
+		infof("[pool] circuit closed for %s", addr)
+		p.notify()
+	}
+}
+
+// Breakers returns the state of every breaker that isn't closed.
+func (p *ProxyPool) Breakers() map[string]string {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	now := time.Now()
+	out := make(map[string]string, len(p.openUntil))
+	for addr := range p.openUntil {
+		out[addr] = p.breakerLocked(addr, now)
+	}
+	return out
+}
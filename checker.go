@@ -1,142 +1,428 @@
 package main
 
 import (
+	"bufio"
+	"context"
+	"encoding/json"
 	"fmt"
-	"io"
-	"log"
 	"net"
+	"net/http"
+	"net/url"
+	"strconv"
 	"strings"
 	"sync"
 	"time"
 )
 
-// Blocked countries: China mainland + Hong Kong (can't access Google)
-var blockedCountries = map[string]bool{
-	"china":     true,
-	"hong kong": true,
+// DefaultCheckURL is the health-check endpoint used when -check-url is unset.
+const DefaultCheckURL = "http://www.google.com/generate_204"
+
+// parseCheckURL splits an http:// check URL into host:port and path.
+func parseCheckURL(raw string) (target, path string, err error) {
+	u, err := url.Parse(raw)
+	if err != nil {
+		return "", "", err
+	}
+	if u.Scheme != "http" {
+		return "", "", fmt.Errorf("check URL must be http://, got %q", raw)
+	}
+	if u.Hostname() == "" {
+		return "", "", fmt.Errorf("check URL has no host: %q", raw)
+	}
+	port := u.Port()
+	if port == "" {
+		port = "80"
+	}
+	path = u.RequestURI()
+	return net.JoinHostPort(u.Hostname(), port), path, nil
+}
+
+// DefaultBlockCountries: China mainland + Hong Kong, whose exits can't
+// reach the default -check-url (Google) or much else abroad
+const DefaultBlockCountries = "CN,HK"
+
+// parseCountries turns a comma-separated list of ISO codes or country
+// names into a set. Keys are upper-cased so "hk", "HK" and "Hong Kong"
+// all normalize predictably.
+func parseCountries(list string) map[string]bool {
+	set := make(map[string]bool)
+	for _, c := range strings.Split(list, ",") {
+		if c = strings.ToUpper(strings.TrimSpace(c)); c != "" {
+			set[c] = true
+		}
+	}
+	return set
+}
+
+// defaultCountryWeight scores countries missing from -country-weights
+// when it has no "*" entry: a proxy from one of them needs half the
+// latency of a weight-1 proxy to rank level with it.
+const defaultCountryWeight = 0.5
+
+// parseCountryWeights parses -country-weights, comma-separated CODE=w
+// pairs with w > 0; "*" sets the weight of unlisted countries. Keys are
+// upper-cased like parseCountries.
+func parseCountryWeights(list string) (map[string]float64, error) {
+	weights := make(map[string]float64)
+	for _, pair := range strings.Split(list, ",") {
+		if pair = strings.TrimSpace(pair); pair == "" {
+			continue
+		}
+		c, w, ok := strings.Cut(pair, "=")
+		c = strings.ToUpper(strings.TrimSpace(c))
+		weight, err := strconv.ParseFloat(strings.TrimSpace(w), 64)
+		if !ok || c == "" || err != nil || weight <= 0 {
+			return nil, fmt.Errorf("expected COUNTRY=weight with weight > 0, got %q", pair)
+		}
+		weights[c] = weight
+	}
+	return weights, nil
+}
+
+// countryAllowed applies the allow/block lists to a checked proxy.
+// A non-empty allowlist takes precedence; otherwise block is a denylist.
+// Matching prefers the ISO code to avoid name-spelling mismatches.
+func countryAllowed(p Proxy, allow, block map[string]bool) bool {
+	match := func(set map[string]bool) bool {
+		return (p.CountryCode != "" && set[strings.ToUpper(p.CountryCode)]) ||
+			set[strings.ToUpper(p.Country)]
+	}
+	if len(allow) > 0 {
+		return match(allow)
+	}
+	return !match(block)
 }
 
 // CheckProxies concurrently checks a list of proxies.
-// Filters out CN/HK IPs, tests Google connectivity.
-func CheckProxies(proxies []Proxy, timeout time.Duration, maxConcurrent int) []Proxy {
+// Applies the country filter, tests connectivity to the configured check URL,
+// then drops proxies that leak our address (or aren't elite, with -elite-only).
+// Up to -max-concurrent proxies are checked at once, but only
+// -geo-concurrent of them look up their geo at a time, since ip-api.com
+// is rate-limited. Cancelling ctx aborts in-flight checks and returns
+// whatever passed so far. failed says why each dropped proxy was
+// dropped, by addr.
+func CheckProxies(ctx context.Context, proxies []Proxy, cfg *Config) (alive []Proxy, failed map[string]error) {
+	failed = make(map[string]error)
 	var (
-		mu    sync.Mutex
-		alive []Proxy
-		wg    sync.WaitGroup
-		sem   = make(chan struct{}, maxConcurrent)
+		mu      sync.Mutex
+		wg      sync.WaitGroup
+		sem     = make(chan struct{}, cfg.MaxConcurrent)
+		geoSem  = make(chan struct{}, cfg.GeoConcurrent)
+		timeout = cfg.CheckTimeout
 	)
 
+	// Our own address, to spot proxies that pass it on
+	var realIP string
+	if cfg.AnonTarget != "" {
+		ip, err := lookupRealIP(ctx, cfg.AnonTarget, cfg.AnonPath, timeout)
+		if err != nil {
+			warnf("[checker] real IP lookup via %s failed, skipping anonymity check: %v", cfg.AnonTarget, err)
+		}
+		realIP = ip
+	}
+
 	for _, p := range proxies {
+		select {
+		case sem <- struct{}{}:
+		case <-ctx.Done():
+		}
+		if ctx.Err() != nil {
+			break
+		}
 		wg.Add(1)
-		sem <- struct{}{}
 		go func(px Proxy) {
 			defer wg.Done()
 			defer func() { <-sem }()
 
-			// Lookup geo first, skip blocked countries
-			country, city := LookupGeo(px.IP, timeout)
-			px.Country = strings.TrimSpace(country)
-			px.City = strings.TrimSpace(city)
-
-			if blockedCountries[strings.ToLower(px.Country)] {
-				log.Printf("[checker] %s skipped (%s)", px.Addr(), px.Country)
-				return
+			// Lookup geo first, unless the list or an earlier check
+			// already did, and skip blocked countries
+			if px.Country == "" || px.Country == "Unknown" {
+				select {
+				case geoSem <- struct{}{}:
+				case <-ctx.Done():
+					return
+				}
+				geolocate(ctx, &px, timeout)
+				<-geoSem
 			}
 
-			if checkGoogle(px, timeout) {
-				log.Printf("[checker] %s OK (%s %s)", px.Addr(), px.Country, px.City)
+			drop := func(err error) {
 				mu.Lock()
-				alive = append(alive, px)
+				failed[px.Addr()] = err
 				mu.Unlock()
 			}
+
+			if !countryAllowed(px, cfg.AllowCountries, cfg.BlockCountries) {
+				debugf("[checker] %s skipped (%s)", px.Addr(), px.Country)
+				drop(fmt.Errorf("exit country %s not allowed", px.Country))
+				return
+			}
+
+			latency, err := checkWithRetries(ctx, px, cfg)
+			if err != nil {
+				drop(err)
+				return
+			}
+			px.Latency = latency
+			px.VerifiedAt = time.Now()
+
+			if realIP != "" {
+				level, err := checkAnonymity(ctx, px, cfg.AnonTarget, cfg.AnonPath, realIP, timeout)
+				if err != nil {
+					debugf("[checker] %s anonymity check failed: %v", px.Addr(), err)
+				}
+				px.Anonymity = level
+				if level == AnonTransparent || (cfg.EliteOnly && level != AnonElite) {
+					debugf("[checker] %s skipped (anonymity: %s)", px.Addr(), orDash(string(level)))
+					drop(fmt.Errorf("anonymity %s", orDash(string(level))))
+					return
+				}
+			}
+
+			if ctx.Err() != nil {
+				return
+			}
+			debugf("[checker] %s OK (%s %s, %dms)", px.Addr(), px.Country, px.City, latency.Milliseconds())
+			mu.Lock()
+			alive = append(alive, px)
+			mu.Unlock()
 		}(p)
 	}
 
 	wg.Wait()
-	log.Printf("[checker] %d/%d proxies alive (Google-verified, non-CN/HK)", len(alive), len(proxies))
-	return alive
+	if ctx.Err() != nil {
+		infof("[checker] check batch cancelled, %d/%d proxies alive so far", len(alive), len(proxies))
+		return alive, failed
+	}
+	infof("[checker] %d/%d proxies alive (verified via %s)", len(alive), len(proxies), cfg.CheckTarget)
+	return alive, failed
 }
 
-// checkGoogle connects through the proxy to Google's 204 endpoint.
-func checkGoogle(p Proxy, timeout time.Duration) bool {
-	conn, err := net.DialTimeout("tcp", p.Addr(), timeout)
-	if err != nil {
+// checkRetryBackoff is the pause before the first retry; it doubles
+// after each further failure.
+const checkRetryBackoff = 500 * time.Millisecond
+
+// checkWithRetries runs checkConnectivity up to 1+CheckRetries times,
+// each attempt with the full CheckTimeout. One success is enough; on
+// failure the last attempt's error is returned.
+func checkWithRetries(ctx context.Context, px Proxy, cfg *Config) (time.Duration, error) {
+	backoff := checkRetryBackoff
+	for attempt := 0; ; attempt++ {
+		latency, err := checkConnectivity(ctx, px, cfg.CheckTarget, cfg.CheckPath, cfg.CheckTimeout)
+		if err == nil {
+			return latency, nil
+		}
+		if attempt >= cfg.CheckRetries || !sleepCtx(ctx, backoff) {
+			return 0, err
+		}
+		backoff *= 2
+	}
+}
+
+// sleepCtx pauses for d, returning false early if ctx is done first.
+func sleepCtx(ctx context.Context, d time.Duration) bool {
+	t := time.NewTimer(d)
+	defer t.Stop()
+	select {
+	case <-t.C:
+		return true
+	case <-ctx.Done():
 		return false
 	}
+}
+
+// checkConnectivity fetches path from target (host:port) over plain
+// HTTP through the proxy. It goes through dialVia so upstream auth and
+// protocol are handled the same way as relays.
+// The returned latency spans dial start to the first response byte.
+// Only a 2xx passes, so a proxy answering with its own error or portal
+// page doesn't count as alive; a 204 must also carry no body. The
+// error says why a proxy failed, for the dashboard.
+func checkConnectivity(ctx context.Context, p Proxy, target, path string, timeout time.Duration) (time.Duration, error) {
+	start := time.Now()
+	conn, err := dialVia(ctx, p, target, timeout)
+	if err != nil {
+		return 0, err
+	}
 	defer conn.Close()
 	conn.SetDeadline(time.Now().Add(timeout))
+	defer context.AfterFunc(ctx, func() { conn.SetDeadline(time.Unix(1, 0)) })()
 
-	// SOCKS5 greeting
-	if _, err := conn.Write([]byte{0x05, 0x01, 0x00}); err != nil {
-		return false
+	host := target
+	if h, port, err := net.SplitHostPort(target); err == nil && port == "80" {
+		host = h
 	}
-	buf := make([]byte, 2)
-	if _, err := io.ReadFull(conn, buf); err != nil || buf[0] != 0x05 {
-		return false
+	httpReq := fmt.Sprintf("GET %s HTTP/1.1\r\nHost: %s\r\nConnection: close\r\n\r\n", path, host)
+	if _, err := conn.Write([]byte(httpReq)); err != nil {
+		return 0, err
 	}
 
-	// Connect to www.google.com:80 through proxy
-	target := "www.google.com"
-	req := []byte{0x05, 0x01, 0x00, 0x03, byte(len(target))}
-	req = append(req, []byte(target)...)
-	req = append(req, 0x00, 0x50) // port 80
-
-	if _, err := conn.Write(req); err != nil {
-		return false
+	br := bufio.NewReader(conn)
+	if _, err := br.Peek(1); err != nil {
+		return 0, fmt.Errorf("no response: %w", err)
 	}
+	latency := time.Since(start)
 
-	resp := make([]byte, 256)
-	n, err := conn.Read(resp)
-	if err != nil || n < 2 || resp[1] != 0x00 {
-		return false
+	// ReadResponse keeps reading until the whole head has arrived, however
+	// it's split across packets
+	resp, err := http.ReadResponse(br, nil)
+	if err != nil {
+		return 0, fmt.Errorf("bad response: %w", err)
 	}
-
-	// Send HTTP request to Google's generate_204 endpoint
-	httpReq := "GET /generate_204 HTTP/1.1\r\nHost: www.google.com\r\nConnection: close\r\n\r\n"
-	if _, err := conn.Write([]byte(httpReq)); err != nil {
-		return false
+	resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return 0, fmt.Errorf("check URL answered %s", resp.Status)
 	}
-
-	respBuf := make([]byte, 512)
-	n, err = conn.Read(respBuf)
-	if err != nil || n < 12 {
-		return false
+	if resp.StatusCode == http.StatusNoContent {
+		if cl := resp.Header.Get("Content-Length"); cl != "" && cl != "0" {
+			return 0, fmt.Errorf("204 with a %s-byte body", cl)
+		}
 	}
+	return latency, nil
+}
+
+// geolocate fills in the proxy's country, country code and city.
+func geolocate(ctx context.Context, px *Proxy, timeout time.Duration) {
+	setGeo(px, lookupGeoInfo(ctx, px.IP, timeout))
+}
+
+// setGeo copies geo's location into px.
+func setGeo(px *Proxy, geo GeoInfo) {
+	px.Country = strings.TrimSpace(geo.Country)
+	px.City = strings.TrimSpace(geo.City)
+	px.CountryCode = strings.ToUpper(strings.TrimSpace(geo.CountryCode))
+}
+
+// geoClient is shared by all geo lookups so connections are reused.
+var geoClient = &http.Client{}
+
+// geoLimiter keeps all geo lookups under ip-api.com's free-tier limit
+// of 45 requests per minute, across the whole check batch.
+var geoLimiter = NewTokenBucket(45, time.Minute, 5)
 
-	// Check we got HTTP response (200 or 204 both fine)
-	return string(respBuf[:4]) == "HTTP"
+// GeoInfo is the subset of the ip-api.com response we use.
+type GeoInfo struct {
+	Status      string `json:"status"`
+	Country     string `json:"country"`
+	CountryCode string `json:"countryCode"`
+	City        string `json:"city"`
 }
 
 // LookupGeo queries ip-api.com for IP geolocation.
 func LookupGeo(ip string, timeout time.Duration) (country, city string) {
-	conn, err := net.DialTimeout("tcp", "ip-api.com:80", timeout)
-	if err != nil {
-		return "Unknown", ""
-	}
-	defer conn.Close()
-	conn.SetDeadline(time.Now().Add(timeout))
+	info := lookupGeoInfo(context.Background(), ip, timeout)
+	return info.Country, info.City
+}
+
+// geoCacheTTL is how long an ip-api.com answer is reused. Where an IP
+// exits rarely changes within a day.
+const geoCacheTTL = 24 * time.Hour
 
-	req := fmt.Sprintf("GET /csv/%s?fields=country,city HTTP/1.1\r\nHost: ip-api.com\r\nConnection: close\r\n\r\n", ip)
-	conn.Write([]byte(req))
+type geoCacheEntry struct {
+	info    GeoInfo
+	expires time.Time
+}
+
+// geoCache keeps ip-api.com answers across refreshes, so a stable list
+// doesn't spend the rate limit on IPs it has already looked up.
+// Expired entries are swept at most once per geoCacheTTL.
+var geoCache = struct {
+	sync.Mutex
+	entries   map[string]geoCacheEntry
+	nextSweep time.Time
+}{entries: make(map[string]geoCacheEntry)}
 
-	buf := make([]byte, 1024)
-	n, err := conn.Read(buf)
-	if err != nil || n == 0 {
-		return "Unknown", ""
+func cachedGeo(ip string) (GeoInfo, bool) {
+	geoCache.Lock()
+	defer geoCache.Unlock()
+	e, ok := geoCache.entries[ip]
+	if !ok || time.Now().After(e.expires) {
+		return GeoInfo{}, false
 	}
+	return e.info, true
+}
 
-	body := string(buf[:n])
-	for i := 0; i < len(body)-3; i++ {
-		if body[i:i+4] == "\r\n\r\n" {
-			body = body[i+4:]
+func cacheGeo(ip string, info GeoInfo) {
+	geoCache.Lock()
+	defer geoCache.Unlock()
+	now := time.Now()
+	if now.After(geoCache.nextSweep) {
+		for k, e := range geoCache.entries {
+			if now.After(e.expires) {
+				delete(geoCache.entries, k)
+			}
+		}
+		geoCache.nextSweep = now.Add(geoCacheTTL)
+	}
+	geoCache.entries[ip] = geoCacheEntry{info: info, expires: now.Add(geoCacheTTL)}
+}
+
+// lookupGeoInfo resolves ip from the local GeoLite2 database if one is
+// loaded, then from geoCache, otherwise queries ip-api.com's JSON
+// endpoint through the shared rate limiter, backing off and retrying
+// once if throttled anyway. On any failure it returns Country "Unknown"
+// so callers can still display something; failures aren't cached.
+func lookupGeoInfo(ctx context.Context, ip string, timeout time.Duration) GeoInfo {
+	if info, ok := lookupLocalGeo(ip); ok {
+		return info
+	}
+	if info, ok := cachedGeo(ip); ok {
+		return info
+	}
+	for attempt := 0; attempt < 2; attempt++ {
+		if geoLimiter.Wait(ctx) != nil {
+			break
+		}
+		info, retryAfter, err := fetchGeo(ctx, ip, timeout)
+		if err == nil {
+			cacheGeo(ip, info)
+			return info
+		}
+		if retryAfter == 0 {
+			break
+		}
+		warnf("[checker] geo lookup rate-limited, retrying %s in %s", ip, retryAfter)
+		if !sleepCtx(ctx, retryAfter) {
 			break
 		}
 	}
+	return GeoInfo{Country: "Unknown"}
+}
+
+// fetchGeo does a single ip-api.com request. On HTTP 429 it returns
+// how long to wait before retrying, from the X-Ttl header.
+func fetchGeo(ctx context.Context, ip string, timeout time.Duration) (GeoInfo, time.Duration, error) {
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
 
-	for i, c := range body {
-		if c == ',' {
-			return body[:i], body[i+1:]
+	u := "http://ip-api.com/json/" + url.PathEscape(ip) + "?fields=status,country,city,countryCode"
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u, nil)
+	if err != nil {
+		return GeoInfo{}, 0, err
+	}
+	resp, err := geoClient.Do(req)
+	if err != nil {
+		return GeoInfo{}, 0, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode == http.StatusTooManyRequests {
+		wait := time.Minute
+		if ttl, err := strconv.Atoi(resp.Header.Get("X-Ttl")); err == nil && ttl > 0 && ttl < 60 {
+			wait = time.Duration(ttl+1) * time.Second
 		}
+		return GeoInfo{}, wait, fmt.Errorf("rate limited")
+	}
+	if resp.StatusCode != http.StatusOK {
+		return GeoInfo{}, 0, fmt.Errorf("unexpected status: %d", resp.StatusCode)
+	}
+
+	var info GeoInfo
+	if err := json.NewDecoder(resp.Body).Decode(&info); err != nil {
+		return GeoInfo{}, 0, err
+	}
+	if info.Status != "success" {
+		return GeoInfo{}, 0, fmt.Errorf("lookup failed for %s", ip)
 	}
-	return body, ""
+	return info, 0, nil
 }
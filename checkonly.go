@@ -0,0 +1,86 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+)
+
+// Report formats for -check-only.
+const (
+	OutputTSV  = "tsv"
+	OutputJSON = "json"
+)
+
+// checkResult is one row of the -check-only report.
+type checkResult struct {
+	Addr      string `json:"addr"`
+	Scheme    string `json:"scheme"`
+	Country   string `json:"country"`
+	City      string `json:"city"`
+	LatencyMs int64  `json:"latency_ms"`
+	Anonymity string `json:"anonymity,omitempty"`
+	Alive     bool   `json:"alive"`
+}
+
+// runCheckOnly scrapes and checks every source once, writes a report of
+// all scraped proxies to stdout and returns the process exit code: 0 if
+// at least one proxy is alive, 1 otherwise. Logs stay on stderr.
+func runCheckOnly(cfg *Config) int {
+	proxies, ok := scrapeAll(context.Background(), cfg, func(string) bool { return false })
+	if !ok {
+		errorf("[scraper] all sources failed")
+		return 1
+	}
+
+	alive := make(map[string]Proxy)
+	checked, _ := CheckProxies(context.Background(), proxies, cfg)
+	for _, px := range checked {
+		alive[px.Addr()] = px
+	}
+
+	results := make([]checkResult, 0, len(proxies))
+	for _, px := range proxies {
+		checked, ok := alive[px.Addr()]
+		if ok {
+			px = checked
+		}
+		results = append(results, checkResult{
+			Addr:      px.Addr(),
+			Scheme:    px.listScheme(),
+			Country:   px.Country,
+			City:      px.City,
+			LatencyMs: px.Latency.Milliseconds(),
+			Anonymity: string(px.Anonymity),
+			Alive:     ok,
+		})
+	}
+
+	if err := writeReport(os.Stdout, results, cfg.Output); err != nil {
+		errorf("[main] write report: %v", err)
+		return 1
+	}
+	if len(alive) == 0 {
+		return 1
+	}
+	return 0
+}
+
+func writeReport(w io.Writer, results []checkResult, format string) error {
+	if format == OutputJSON {
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "  ")
+		return enc.Encode(results)
+	}
+
+	fmt.Fprintln(w, "addr\tscheme\tcountry\tcity\tlatency_ms\tanonymity\talive")
+	for _, r := range results {
+		if _, err := fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%d\t%s\t%t\n",
+			r.Addr, r.Scheme, r.Country, r.City, r.LatencyMs, r.Anonymity, r.Alive); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,28 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestParseCredLine(t *testing.T) {
+	long := strings.Repeat("x", maxAuthLen+1)
+	tests := []struct {
+		line    string
+		addr    string
+		wantErr bool
+	}{
+		{"alice:s3cret@1.2.3.4:1080", "1.2.3.4:1080", false},
+		{"socks5://alice:p@ss@[::1]:1080", "[::1]:1080", false},
+		{strings.Repeat("u", maxAuthLen) + ":" + strings.Repeat("p", maxAuthLen) + "@1.2.3.4:1080", "1.2.3.4:1080", false},
+		{long + ":pass@1.2.3.4:1080", "", true},
+		{"user:" + long + "@1.2.3.4:1080", "", true},
+		{"1.2.3.4:1080", "", true},
+	}
+	for _, tt := range tests {
+		addr, _, err := parseCredLine(tt.line)
+		if (err != nil) != tt.wantErr || addr != tt.addr {
+			t.Errorf("parseCredLine(%.40q) = %q, %v; want %q, error %v", tt.line, addr, err, tt.addr, tt.wantErr)
+		}
+	}
+}
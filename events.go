@@ -0,0 +1,117 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// Pool event types sent on /api/events.
+const (
+	EventProxyAdded      = "proxy_added"
+	EventProxyEvicted    = "proxy_evicted"
+	EventActiveSwitched  = "active_switched"
+	EventScrapeCompleted = "scrape_completed"
+)
+
+// PoolEvent is one change to the pool, as delivered to OnEvent hooks.
+type PoolEvent struct {
+	Type   string    `json:"type"`
+	Time   time.Time `json:"time"`
+	Addr   string    `json:"addr,omitempty"`   // proxy concerned; the new active one for active_switched
+	Prev   string    `json:"prev,omitempty"`   // previously active proxy, for active_switched
+	Reason string    `json:"reason,omitempty"` // why a proxy was evicted
+	Error  string    `json:"error,omitempty"`  // the evicted proxy's last error
+	Total  int       `json:"total"`            // pool size after the event
+}
+
+// eventBuffer is how many events a slow /api/events client may fall
+// behind before the oldest are dropped.
+const eventBuffer = 64
+
+// eventHub fans PoolEvents out to /api/events clients. Publishing never
+// blocks: a client whose buffer is full loses its oldest event.
+type eventHub struct {
+	mu   sync.Mutex
+	subs map[chan PoolEvent]struct{}
+}
+
+func newEventHub() *eventHub {
+	return &eventHub{subs: make(map[chan PoolEvent]struct{})}
+}
+
+func (h *eventHub) Subscribe() (<-chan PoolEvent, func()) {
+	ch := make(chan PoolEvent, eventBuffer)
+	h.mu.Lock()
+	h.subs[ch] = struct{}{}
+	h.mu.Unlock()
+	return ch, func() {
+		h.mu.Lock()
+		delete(h.subs, ch)
+		h.mu.Unlock()
+	}
+}
+
+func (h *eventHub) Publish(ev PoolEvent) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for ch := range h.subs {
+		select {
+		case ch <- ev:
+			continue
+		default:
+		}
+		// Full: drop the oldest to make room
+		select {
+		case <-ch:
+		default:
+		}
+		select {
+		case ch <- ev:
+		default:
+		}
+	}
+}
+
+// eventKeepalive is how often an idle /api/events stream gets a comment
+// line, so proxies in front of us don't time it out.
+const eventKeepalive = 15 * time.Second
+
+// handleEvents streams PoolEvents as Server-Sent Events until the
+// client goes away.
+func (s *StatusServer) handleEvents(w http.ResponseWriter, r *http.Request) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "streaming unsupported", http.StatusInternalServerError)
+		return
+	}
+	events, cancel := s.events.Subscribe()
+	defer cancel()
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+
+	ticker := time.NewTicker(eventKeepalive)
+	defer ticker.Stop()
+	for {
+		select {
+		case ev := <-events:
+			data, _ := json.Marshal(ev)
+			if _, err := fmt.Fprintf(w, "event: %s\ndata: %s\n\n", ev.Type, data); err != nil {
+				return
+			}
+		case <-ticker.C:
+			if _, err := io.WriteString(w, ": keepalive\n\n"); err != nil {
+				return
+			}
+		case <-r.Context().Done():
+			return
+		}
+		flusher.Flush()
+	}
+}
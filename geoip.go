@@ -0,0 +1,51 @@
+package main
+
+import (
+	"net"
+
+	"github.com/oschwald/geoip2-golang"
+)
+
+// geoDB is the optional local GeoLite2 database set by OpenGeoDB.
+// When nil, all lookups go to ip-api.com.
+var geoDB *geoip2.Reader
+
+// OpenGeoDB loads a GeoLite2-City .mmdb file for offline lookups.
+func OpenGeoDB(path string) error {
+	db, err := geoip2.Open(path)
+	if err != nil {
+		return err
+	}
+	geoDB = db
+	return nil
+}
+
+// CloseGeoDB releases the local database, if one is open.
+func CloseGeoDB() {
+	if geoDB != nil {
+		geoDB.Close()
+	}
+}
+
+// lookupLocalGeo resolves ip against the local database. It reports
+// false when no database is loaded or the IP isn't in it, so the
+// caller can fall back to ip-api.com.
+func lookupLocalGeo(ip string) (GeoInfo, bool) {
+	if geoDB == nil {
+		return GeoInfo{}, false
+	}
+	parsed := net.ParseIP(ip)
+	if parsed == nil {
+		return GeoInfo{}, false
+	}
+	rec, err := geoDB.City(parsed)
+	if err != nil || rec.Country.IsoCode == "" {
+		return GeoInfo{}, false
+	}
+	return GeoInfo{
+		Status:      "success",
+		Country:     rec.Country.Names["en"],
+		CountryCode: rec.Country.IsoCode,
+		City:        rec.City.Names["en"],
+	}, true
+}
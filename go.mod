@@ -1,3 +1,10 @@
 module socks5-pool
 
 go 1.23
+
+require github.com/oschwald/geoip2-golang v1.11.0
+
+require (
+	github.com/oschwald/maxminddb-golang v1.13.0 // indirect
+	golang.org/x/sys v0.20.0 // indirect
+)
@@ -0,0 +1,64 @@
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// connectHTTP asks the HTTP proxy on conn to tunnel to target using
+// CONNECT. The response is read byte by byte up to the blank line so
+// no tunneled bytes are swallowed by a buffer. The caller owns conn
+// and closes it on error.
+func connectHTTP(conn net.Conn, upstream Proxy, target string, timeout time.Duration) error {
+	conn.SetDeadline(time.Now().Add(timeout))
+
+	req := fmt.Sprintf("CONNECT %s HTTP/1.1\r\nHost: %s\r\n", target, target)
+	if upstream.User != "" {
+		cred := base64.StdEncoding.EncodeToString([]byte(upstream.User + ":" + upstream.Pass))
+		req += "Proxy-Authorization: Basic " + cred + "\r\n"
+	}
+	req += "\r\n"
+	if _, err := conn.Write([]byte(req)); err != nil {
+		return err
+	}
+
+	head, err := readHTTPHead(conn)
+	if err != nil {
+		return err
+	}
+	statusLine, _, _ := strings.Cut(head, "\r\n")
+	fields := strings.Fields(statusLine)
+	if len(fields) < 2 || !strings.HasPrefix(fields[0], "HTTP/") {
+		return fmt.Errorf("not an http proxy")
+	}
+	// Any 2xx establishes the tunnel (RFC 9110 9.3.6)
+	if code, err := strconv.Atoi(fields[1]); err != nil || len(fields[1]) != 3 || code < 200 || code > 299 {
+		return fmt.Errorf("upstream connect failed, status: %s", fields[1])
+	}
+
+	// Clear deadline for relay
+	conn.SetDeadline(time.Time{})
+	return nil
+}
+
+// readHTTPHead reads a response head up to and including CRLFCRLF.
+func readHTTPHead(r io.Reader) (string, error) {
+	var buf bytes.Buffer
+	b := make([]byte, 1)
+	for buf.Len() < 8192 {
+		if _, err := io.ReadFull(r, b); err != nil {
+			return "", err
+		}
+		buf.WriteByte(b[0])
+		if bytes.HasSuffix(buf.Bytes(), []byte("\r\n\r\n")) {
+			return buf.String(), nil
+		}
+	}
+	return "", fmt.Errorf("response head too large")
+}
@@ -0,0 +1,42 @@
+package main
+
+import (
+	"bufio"
+	"net"
+	"net/http"
+	"testing"
+)
+
+func TestConnectHTTPStatus(t *testing.T) {
+	tests := []struct {
+		status string
+		wantOK bool
+	}{
+		{"200 Connection established", true},
+		{"201 Created", true},
+		{"204 No Content", true},
+		{"299 Whatever", true},
+		{"300 Multiple Choices", false},
+		{"407 Proxy Authentication Required", false},
+		{"502 Bad Gateway", false},
+		{"2000 Odd", false},
+		{"abc Broken", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.status, func(t *testing.T) {
+			client, proxy := net.Pipe()
+			defer client.Close()
+			go func() {
+				defer proxy.Close()
+				if _, err := http.ReadRequest(bufio.NewReader(proxy)); err != nil {
+					return
+				}
+				proxy.Write([]byte("HTTP/1.1 " + tt.status + "\r\n\r\n"))
+			}()
+			err := connectHTTP(client, Proxy{Scheme: SchemeHTTP}, "example.com:443", testTimeout)
+			if (err == nil) != tt.wantOK {
+				t.Errorf("connectHTTP = %v; want success %v", err, tt.wantOK)
+			}
+		})
+	}
+}
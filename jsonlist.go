@@ -0,0 +1,129 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"mime"
+	"net"
+	"strconv"
+	"strings"
+)
+
+// jsonProxy is one entry of a JSON proxy list. Field names vary between
+// providers, so the common spellings are accepted.
+type jsonProxy struct {
+	IP          string          `json:"ip"`
+	Host        string          `json:"host"`
+	Port        json.RawMessage `json:"port"` // number or string
+	Scheme      string          `json:"scheme"`
+	Protocol    string          `json:"protocol"`
+	User        string          `json:"user"`
+	Username    string          `json:"username"`
+	Pass        string          `json:"pass"`
+	Password    string          `json:"password"`
+	Country     string          `json:"country"`
+	CountryCode string          `json:"country_code"`
+	City        string          `json:"city"`
+}
+
+// maxJSONList bounds the size of a JSON list, which unlike a text list
+// has to be read whole.
+const maxJSONList = 32 << 20
+
+// parseJSONList reads a JSON proxy list: a top-level array of entries
+// or a {"proxies": [...]} envelope. Country and city are kept when the
+// source gives them, so the checker can skip the geo lookup. Entries
+// are validated and deduped like text lists.
+func parseJSONList(r io.Reader) ([]Proxy, error) {
+	data, err := io.ReadAll(io.LimitReader(r, maxJSONList))
+	if err != nil {
+		return nil, err
+	}
+	data = bytes.TrimSpace(data)
+
+	var entries []jsonProxy
+	if bytes.HasPrefix(data, []byte("{")) {
+		var env struct {
+			Proxies []jsonProxy `json:"proxies"`
+		}
+		err = json.Unmarshal(data, &env)
+		entries = env.Proxies
+	} else {
+		err = json.Unmarshal(data, &entries)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("invalid JSON list: %w", err)
+	}
+
+	var proxies []Proxy
+	seen := make(map[string]bool, len(entries))
+	invalid := 0
+	for _, e := range entries {
+		px, ok := e.proxy()
+		if !ok {
+			invalid++
+			continue
+		}
+		if seen[px.Addr()] {
+			continue
+		}
+		seen[px.Addr()] = true
+		proxies = append(proxies, px)
+	}
+	if invalid > 0 {
+		warnf("[scraper] skipped %d entries with an invalid IP, port, scheme or credentials", invalid)
+	}
+	return proxies, nil
+}
+
+func (e jsonProxy) proxy() (Proxy, bool) {
+	host := strings.Trim(firstNonEmpty(e.IP, e.Host), "[] ")
+	port := strings.Trim(string(e.Port), `" `)
+	if host == "" || !validHostPort(host, port) {
+		return Proxy{}, false
+	}
+	// Normalise the port, "01080" and 1080 are the same proxy
+	n, _ := strconv.Atoi(port)
+	px := Proxy{
+		IP:      host,
+		Port:    strconv.Itoa(n),
+		User:    firstNonEmpty(e.User, e.Username),
+		Pass:    firstNonEmpty(e.Pass, e.Password),
+		Country: strings.TrimSpace(e.Country),
+		City:    strings.TrimSpace(e.City),
+	}
+	if !validAuth(px.User, px.Pass) {
+		return Proxy{}, false
+	}
+	var ok bool
+	if px.Scheme, px.TLS, ok = proxyScheme(firstNonEmpty(e.Scheme, e.Protocol)); !ok {
+		return Proxy{}, false
+	}
+	px.CountryCode = strings.ToUpper(strings.TrimSpace(e.CountryCode))
+	// Many lists put the ISO code in "country"
+	if px.CountryCode == "" && len(px.Country) == 2 {
+		px.CountryCode = strings.ToUpper(px.Country)
+		px.Country = px.CountryCode
+	}
+	if ip := net.ParseIP(host); ip != nil {
+		px.IP = ip.String()
+	}
+	return px, true
+}
+
+func firstNonEmpty(vals ...string) string {
+	for _, v := range vals {
+		if v = strings.TrimSpace(v); v != "" {
+			return v
+		}
+	}
+	return ""
+}
+
+// isJSONType reports whether a Content-Type header names JSON.
+func isJSONType(contentType string) bool {
+	mt, _, err := mime.ParseMediaType(contentType)
+	return err == nil && (mt == "application/json" || strings.HasSuffix(mt, "+json"))
+}
@@ -0,0 +1,72 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"log/slog"
+	"os"
+	"strings"
+)
+
+// Log output formats for -log-format.
+const (
+	LogFormatText = "text"
+	LogFormatJSON = "json"
+)
+
+// logLevel is the minimum level written, from -log-level.
+var logLevel = slog.LevelInfo
+
+// jsonLogger is set by -log-format json. When nil, lines go through
+// the standard log package as plain text.
+var jsonLogger *slog.Logger
+
+// SetupLogging applies -log-level and -log-format. Until it runs,
+// INFO and above is written as text.
+func SetupLogging(level slog.Level, format string) {
+	logLevel = level
+	if format == LogFormatJSON {
+		jsonLogger = slog.New(slog.NewJSONHandler(os.Stderr, &slog.HandlerOptions{Level: level}))
+	}
+}
+
+// debugf is for per-proxy detail that floods the log on large pools.
+func debugf(format string, args ...any) { logf(slog.LevelDebug, format, args...) }
+
+// infof is for lifecycle events and pool changes.
+func infof(format string, args ...any) { logf(slog.LevelInfo, format, args...) }
+
+// warnf is for failures we recover from.
+func warnf(format string, args ...any) { logf(slog.LevelWarn, format, args...) }
+
+// errorf is for failures that leave something not working.
+func errorf(format string, args ...any) { logf(slog.LevelError, format, args...) }
+
+// fatalf logs at ERROR and exits with status 1.
+func fatalf(format string, args ...any) {
+	logf(slog.LevelError, format, args...)
+	os.Exit(1)
+}
+
+// logf writes one message at level. Messages start with a
+// "[component]" tag by convention; JSON output moves it to its own
+// field so it can be filtered on.
+func logf(level slog.Level, format string, args ...any) {
+	if level < logLevel {
+		return
+	}
+	msg := fmt.Sprintf(format, args...)
+	if jsonLogger == nil {
+		log.Output(3, fmt.Sprintf("%-5s %s", level, msg))
+		return
+	}
+	var attrs []any
+	if rest, ok := strings.CutPrefix(msg, "["); ok {
+		if component, text, ok := strings.Cut(rest, "] "); ok {
+			attrs = append(attrs, "component", component)
+			msg = text
+		}
+	}
+	jsonLogger.Log(context.Background(), level, strings.TrimSpace(msg), attrs...)
+}
@@ -1,111 +1,573 @@
 package main
 
 import (
-	"log"
+	"context"
+	"fmt"
 	"math/rand"
+	"os"
+	"os/signal"
 	"sync"
+	"syscall"
 	"time"
 )
 
+// shutdownTimeout bounds how long we wait for relays to drain on exit.
+const shutdownTimeout = 10 * time.Second
+
+// emptyPoolCheck is how often an empty pool triggers a refresh when
+// auto-rotation is disabled.
+const emptyPoolCheck = 3 * time.Minute
+
+// maxStatusBackoff caps the delay between dashboard bind retries, and
+// between self-test retries.
+const maxStatusBackoff = time.Minute
+
+// selfTestRetry is the first delay before a failed self-test is rerun.
+const selfTestRetry = 5 * time.Second
+
+// maxScrapeBackoff caps the delay between scheduled scrapes while every
+// source keeps failing, unless -scrape-interval is longer still.
+const maxScrapeBackoff = time.Hour
+
 var (
 	lastScrapeTime time.Time
 	nextScrapeTime time.Time
+	scrapeFailures int // consecutive refreshes in which every source failed
 	scrapeMu       sync.RWMutex
 	refreshChan    = make(chan struct{}, 1) // manual refresh trigger
+
+	refreshMu      sync.Mutex
+	refreshGen     int
+	cancelRefresh  context.CancelFunc // aborts the in-flight refresh, if any
+	triggerSeq     int                // manual triggers so far
+	refreshWaiters []refreshWaiter
 )
 
+// refreshWaiter is closed by the first refresh to finish that started
+// after manual trigger number seq.
+type refreshWaiter struct {
+	seq  int
+	done chan struct{}
+}
+
 func getScrapeTimes() (last, next time.Time) {
 	scrapeMu.RLock()
 	defer scrapeMu.RUnlock()
 	return lastScrapeTime, nextScrapeTime
 }
 
+// scrapeBackingOff reports whether the last refresh found every source
+// down, so scheduled scrapes are backing off.
+func scrapeBackingOff() bool {
+	scrapeMu.RLock()
+	defer scrapeMu.RUnlock()
+	return scrapeFailures > 0
+}
+
+// scrapeDelay is the wait before the next scheduled scrape after
+// failures refreshes in a row in which every source failed: the
+// interval, doubled per failure up to maxScrapeBackoff, with jitter
+// over the upper half so instances sharing a source drift apart. It is
+// never shorter than the interval.
+func scrapeDelay(interval time.Duration, failures int) time.Duration {
+	if failures == 0 {
+		return interval
+	}
+	limit := max(interval, maxScrapeBackoff)
+	d := interval
+	for i := 0; i < failures && d < limit; i++ {
+		d *= 2
+	}
+	d = min(d, limit)
+	return max(interval, d/2+time.Duration(rand.Int63n(int64(d/2)+1)))
+}
+
 func main() {
-	cfg := ParseConfig()
+	cfg, err := ParseConfig()
+	if err != nil {
+		fatalf("[config] %v", err)
+	}
+	SetupLogging(cfg.LogLevel, cfg.LogFormat)
+	if cfg.NagiosCheck {
+		os.Exit(runNagiosCheck(cfg))
+	}
+
+	infof("socks5-pool starting...")
+	infof("  listen:   %s", cfg.ListenAddr)
+	infof("  status:   %s", cfg.StatusAddr)
+	for _, u := range cfg.ScrapeURLs {
+		infof("  source:   %s", redactURL(u))
+	}
+	infof("  scrape:   every %s", cfg.ScrapeInterval)
+	infof("  strategy: %s", cfg.Strategy)
+	if len(cfg.Credentials) > 0 {
+		infof("  auth:     %d user(s)", len(cfg.Credentials))
+	}
+	if len(cfg.ProxyCredentials) > 0 {
+		infof("  upstream: credentials for %d proxies", len(cfg.ProxyCredentials))
+	}
+	if cfg.AllowDirect {
+		infof("  direct:   fallback enabled, traffic may bypass the pool")
+	}
+
+	if cfg.GeoIPDB != "" {
+		if err := OpenGeoDB(cfg.GeoIPDB); err != nil {
+			warnf("[geoip] open %s: %v, using ip-api.com", cfg.GeoIPDB, err)
+		} else {
+			infof("  geoip:    %s", cfg.GeoIPDB)
+			defer CloseGeoDB()
+		}
+	}
+
+	tlsInsecure = cfg.TLSInsecure
+
+	if cfg.CheckOnly {
+		code := runCheckOnly(cfg)
+		CloseGeoDB()
+		os.Exit(code)
+	}
 
-	log.Printf("socks5-pool starting...")
-	log.Printf("  listen:   %s", cfg.ListenAddr)
-	log.Printf("  status:   %s", cfg.StatusAddr)
-	log.Printf("  source:   %s", cfg.ScrapeURL)
-	log.Printf("  scrape:   every %s", cfg.ScrapeInterval)
+	pool := NewProxyPool(cfg)
+	pool.OnSwitch(func(old, cur Proxy) {
+		if cur.IP == "" {
+			warnf("[pool] no active proxy, pool is empty")
+			return
+		}
+		infof("[pool] active proxy: %s (%s %s)", cur.Addr(), cur.Country, cur.City)
+	})
 
-	pool := NewProxyPool()
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
 
 	// Initial scrape + check
-	refreshPool(cfg, pool)
+	scraped := refreshPool(ctx, cfg, pool)
 
 	if pool.Size() == 0 {
-		log.Printf("[warn] no alive proxies found, will retry on next scrape cycle")
+		warnf("[main] no alive proxies found, will retry on next scrape cycle")
 	}
 
-	// Background: periodic scrape + manual refresh
+	// Background: periodic scrape + manual refresh. A manual refresh
+	// replaces one already in flight; a scheduled one waits its turn.
+	// The next scheduled scrape is timed from the end of the last
+	// refresh, and backs off while every source keeps failing; manual
+	// refreshes still go through.
 	go func() {
-		ticker := time.NewTicker(cfg.ScrapeInterval)
-		defer ticker.Stop()
+		results := make(chan bool, 1)
+		start := func() {
+			go func() {
+				ok := refreshPool(ctx, cfg, pool)
+				select {
+				case results <- ok:
+				case <-ctx.Done():
+				}
+			}()
+		}
+		// settle records a refresh outcome and returns the delay
+		// before the next scheduled scrape
+		settle := func(ok bool) time.Duration {
+			scrapeMu.Lock()
+			defer scrapeMu.Unlock()
+			if ok {
+				if scrapeFailures > 0 {
+					infof("[main] scraping recovered after %d failed attempts, back to every %s", scrapeFailures, cfg.ScrapeInterval)
+				}
+				scrapeFailures = 0
+			} else {
+				scrapeFailures++
+			}
+			delay := scrapeDelay(cfg.ScrapeInterval, scrapeFailures)
+			if scrapeFailures > 0 {
+				warnf("[main] all sources failed (%d in a row), backing off: next scrape in %s",
+					scrapeFailures, delay.Round(time.Second))
+			}
+			nextScrapeTime = time.Now().Add(delay)
+			return delay
+		}
+
+		timer := time.NewTimer(settle(scraped))
+		defer timer.Stop()
 		for {
 			select {
-			case <-ticker.C:
-				refreshPool(cfg, pool)
+			case <-ctx.Done():
+				return
+			case <-timer.C:
+				// The running refresh's result re-arms the timer
+				if refreshInFlight() {
+					infof("[main] previous refresh still running, skipping scheduled refresh")
+					continue
+				}
+				start()
 			case <-refreshChan:
-				log.Printf("[main] manual refresh triggered")
-				refreshPool(cfg, pool)
-				ticker.Reset(cfg.ScrapeInterval)
+				infof("[main] manual refresh triggered")
+				start()
+			case ok := <-results:
+				timer.Reset(settle(ok))
 			}
 		}
 	}()
 
-	// Background: random proxy rotation every 3-6 minutes
-	// If pool is empty, trigger immediate refresh instead of rotating
+	// Background: re-check proxies older than -proxy-ttl between refreshes
+	if cfg.ProxyTTL > 0 {
+		go func() {
+			ticker := time.NewTicker(max(cfg.ProxyTTL/4, time.Second))
+			defer ticker.Stop()
+			for {
+				select {
+				case <-ctx.Done():
+					return
+				case <-ticker.C:
+					// A refresh re-checks the whole pool anyway
+					if !refreshInFlight() {
+						recheckStale(ctx, cfg, pool)
+					}
+				}
+			}
+		}()
+	}
+
+	// Background: rotate every -rotate-interval plus up to -rotate-jitter.
+	// If pool is empty, trigger immediate refresh instead of rotating;
+	// that check keeps running even with rotation disabled.
 	go func() {
 		for {
-			delay := 3*time.Minute + time.Duration(rand.Intn(4))*time.Minute
-			time.Sleep(delay)
-			if pool.Size() == 0 {
-				log.Printf("[main] pool empty, triggering immediate refresh")
+			delay := cfg.RotateInterval
+			if delay <= 0 {
+				delay = emptyPoolCheck
+			} else if cfg.RotateJitter > 0 {
+				delay += time.Duration(rand.Int63n(int64(cfg.RotateJitter) + 1))
+			}
+			select {
+			case <-ctx.Done():
+				return
+			case <-time.After(delay):
+			}
+			if pool.Size() == 0 && !refreshInFlight() && !scrapeBackingOff() {
+				infof("[main] pool empty, triggering immediate refresh")
 				TriggerRefresh()
-			} else if pool.Size() > 1 {
-				pool.SwitchNext()
+			} else if cfg.RotateInterval > 0 && pool.Size() > 1 {
+				pool.Rotate()
 			}
 		}
 	}()
 
-	// Background: status dashboard
+	server := NewServer(cfg, pool)
+	if cfg.AccessLog != "" {
+		al, err := OpenAccessLog(cfg.AccessLog)
+		if err != nil {
+			fatalf("[main] access log: %v", err)
+		}
+		defer al.Close()
+		server.AccessLog = al
+	}
+
+	// Admin socket: a scriptable alternative to the dashboard
+	if cfg.AdminSocket != "" {
+		admin, err := ListenAdmin(cfg.AdminSocket, pool, server)
+		if err != nil {
+			fatalf("[admin] %v", err)
+		}
+		defer admin.Close()
+		infof("[admin] listening on %s", cfg.AdminSocket)
+		go admin.Serve()
+	}
+
+	// Fatal errors from the SOCKS5 server, the dashboard if required,
+	// and the self-test with -strict-startup
+	errCh := make(chan error, 3)
+
+	// Background: status dashboard. If it can't bind (port taken, say)
+	// keep retrying rather than running without it unnoticed, or exit
+	// with -require-status.
 	go func() {
-		status := NewStatusServer(pool)
-		log.Printf("[status] dashboard at http://%s", cfg.StatusAddr)
-		if err := status.Start(cfg.StatusAddr); err != nil {
-			log.Printf("[status] failed to start: %v", err)
+		status := NewStatusServer(cfg, pool, server)
+		backoff := time.Second
+		for {
+			infof("[status] dashboard at %s://%s", cfg.StatusScheme(), cfg.StatusAddr)
+			err := status.Start(cfg.StatusAddr)
+			if cfg.RequireStatus {
+				errCh <- fmt.Errorf("[status] %w", err)
+				return
+			}
+			errorf("[status] failed: %v, dashboard DOWN, retrying in %s", err, backoff)
+			select {
+			case <-ctx.Done():
+				return
+			case <-time.After(backoff):
+			}
+			backoff = min(backoff*2, maxStatusBackoff)
 		}
 	}()
 
-	// Start SOCKS5 server (blocks)
-	server := NewServer(cfg.ListenAddr, pool)
-	log.Fatal(server.Start())
-}
+	// Start SOCKS5 server, run until it fails or we get a signal. After
+	// /api/drain it returns nil and we keep running until signalled.
+	go func() {
+		if err := server.Start(); err != nil {
+			errCh <- err
+		}
+	}()
 
-func refreshPool(cfg *Config, pool *ProxyPool) {
-	proxies, err := Scrape(cfg.ScrapeURL)
-	if err != nil {
-		log.Printf("[error] scrape failed: %v", err)
+	// Prove the listener can relay before real clients find out it
+	// can't. /readyz fails until it does, so a load balancer holds
+	// traffic back; without -strict-startup a failure is retried.
+	go func() {
+		select {
+		case <-server.Ready():
+		case <-ctx.Done():
+			return
+		}
+		backoff := selfTestRetry
+		for {
+			err := selfTest(ctx, cfg, server)
+			if err == nil {
+				server.MarkVerified()
+				return
+			}
+			if ctx.Err() != nil {
+				return
+			}
+			if cfg.StrictStartup {
+				errCh <- fmt.Errorf("self-test failed: %w", err)
+				return
+			}
+			warnf("[main] self-test failed: %v; /readyz stays unready, retrying in %s", err, backoff)
+			select {
+			case <-ctx.Done():
+				return
+			case <-time.After(backoff):
+			}
+			backoff = min(backoff*2, maxStatusBackoff)
+		}
+	}()
+
+	select {
+	case err := <-errCh:
+		fatalf("[main] %v", err)
+	case <-ctx.Done():
+	}
+
+	infof("[main] shutting down, draining connections...")
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+	defer cancel()
+	if err := server.Shutdown(shutdownCtx); err != nil {
+		warnf("[main] drain timed out after %s, exiting anyway", shutdownTimeout)
 		return
 	}
+	infof("[main] shutdown complete")
+}
 
-	alive := CheckProxies(proxies, cfg.CheckTimeout, cfg.MaxConcurrent)
-	pool.Update(alive)
+// maxConcurrentScrapes bounds how many sources are fetched at once.
+const maxConcurrentScrapes = 4
 
+// scrapeAll fetches all sources concurrently, then merges them in
+// configured order, deduplicating by address and dropping addresses
+// skip rejects, so the result doesn't depend on which source answered
+// first. A failing source is skipped rather than aborting; ok is false
+// only if every source failed. Auth from -credentials-file is filled
+// in last. Cancelling ctx aborts the fetches still in flight.
+func scrapeAll(ctx context.Context, cfg *Config, skip func(addr string) bool) (proxies []Proxy, ok bool) {
+	type result struct {
+		list []Proxy
+		err  error
+	}
+	results := make([]result, len(cfg.Sources))
+	sem := make(chan struct{}, maxConcurrentScrapes)
+	var wg sync.WaitGroup
+	for i, src := range cfg.Sources {
+		wg.Add(1)
+		sem <- struct{}{}
+		go func(i int, src Source) {
+			defer wg.Done()
+			defer func() { <-sem }()
+			list, err := src.Fetch(ctx)
+			results[i] = result{list, err}
+		}(i, src)
+	}
+	wg.Wait()
+
+	seen := make(map[string]bool)
+	failed := 0
+	for i, r := range results {
+		src := cfg.Sources[i]
+		if r.err != nil {
+			warnf("[scraper] scrape %s failed: %v", src, r.err)
+			failed++
+			continue
+		}
+		added := 0
+		for _, p := range r.list {
+			if seen[p.Addr()] || skip(p.Addr()) {
+				continue
+			}
+			seen[p.Addr()] = true
+			proxies = append(proxies, p)
+			added++
+		}
+		infof("[scraper] fetched %d proxies from %s (%d new)", len(r.list), src, added)
+	}
+	applyCredentials(proxies, cfg.ProxyCredentials)
+	return proxies, failed < len(cfg.Sources)
+}
+
+// beginRefresh cancels any refresh still in flight and returns the
+// context for a new one, plus the func to call when it finishes. If
+// it finishes uncancelled, that func releases the TriggerRefresh
+// callers waiting on it; a cancelled one leaves them to its successor.
+func beginRefresh(parent context.Context) (context.Context, func()) {
+	ctx, cancel := context.WithCancel(parent)
+	refreshMu.Lock()
+	defer refreshMu.Unlock()
+	if cancelRefresh != nil {
+		cancelRefresh()
+	}
+	refreshGen++
+	gen := refreshGen
+	seq := triggerSeq
+	cancelRefresh = cancel
+	return ctx, func() {
+		completed := ctx.Err() == nil
+		cancel()
+		refreshMu.Lock()
+		defer refreshMu.Unlock()
+		if refreshGen == gen {
+			cancelRefresh = nil
+		}
+		if !completed {
+			return
+		}
+		pending := refreshWaiters[:0]
+		for _, w := range refreshWaiters {
+			if w.seq <= seq {
+				close(w.done)
+			} else {
+				pending = append(pending, w)
+			}
+		}
+		refreshWaiters = pending
+	}
+}
+
+// refreshInFlight reports whether a refresh is currently running.
+func refreshInFlight() bool {
+	refreshMu.Lock()
+	defer refreshMu.Unlock()
+	return cancelRefresh != nil
+}
+
+// refreshPool scrapes, checks and swaps in a new pool. Starting one
+// cancels the scrape or check batch of any refresh still running, and a
+// cancelled refresh leaves the pool untouched. It returns false only
+// if every source failed, for the scrape loop's backoff.
+func refreshPool(parent context.Context, cfg *Config, pool *ProxyPool) bool {
+	ctx, done := beginRefresh(parent)
+	defer done()
+
+	proxies, ok := scrapeAll(ctx, cfg, pool.Blacklisted)
+	if ctx.Err() != nil {
+		infof("[main] refresh cancelled, keeping current pool")
+		return true
+	}
+	if !ok {
+		errorf("[scraper] all sources failed, keeping current pool")
+		return false
+	}
+	seen := make(map[string]bool, len(proxies))
+	for _, p := range proxies {
+		seen[p.Addr()] = true
+	}
+
+	// Re-check the current pool too, so proxies that dropped off the
+	// source lists are only removed once they actually stop working
+	for _, p := range pool.All() {
+		if !seen[p.Addr()] {
+			seen[p.Addr()] = true
+			proxies = append(proxies, p)
+		}
+	}
+
+	alive, failed := CheckProxies(ctx, proxies, cfg)
+	if ctx.Err() != nil {
+		infof("[main] refresh cancelled, keeping current pool")
+		return true
+	}
+	pool.RecordChecks(proxies, alive, failed)
+
+	// Set the times first so dashboard subscribers woken by Update see them
 	scrapeMu.Lock()
 	lastScrapeTime = time.Now()
 	nextScrapeTime = lastScrapeTime.Add(cfg.ScrapeInterval)
 	scrapeMu.Unlock()
 
-	log.Printf("[main] pool refreshed: %d alive proxies", pool.Size())
+	// A blip that fails most checks shouldn't empty a working pool
+	if len(alive) < cfg.MinPoolSize && len(alive) < pool.Size() {
+		warnf("[main] only %d proxies passed checks (min %d), keeping current pool of %d",
+			len(alive), cfg.MinPoolSize, pool.Size())
+		return true
+	}
+	pool.Update(alive, failed)
+	pool.Emit(PoolEvent{Type: EventScrapeCompleted})
+
+	infof("[main] pool refreshed: %d alive proxies", pool.Size())
+	return true
+}
+
+// recheckStale re-verifies the proxies last checked more than
+// -proxy-ttl ago and evicts those that fail. Only connectivity is
+// tested; geo and anonymity don't change between refreshes.
+func recheckStale(ctx context.Context, cfg *Config, pool *ProxyPool) {
+	stale := pool.Stale(cfg.ProxyTTL)
+	if len(stale) == 0 {
+		return
+	}
+
+	var (
+		mu     sync.Mutex
+		alive  []Proxy
+		failed = make(map[string]error)
+		wg     sync.WaitGroup
+		sem    = make(chan struct{}, cfg.MaxConcurrent)
+	)
+	for _, p := range stale {
+		wg.Add(1)
+		sem <- struct{}{}
+		go func(px Proxy) {
+			defer wg.Done()
+			defer func() { <-sem }()
+			latency, err := checkWithRetries(ctx, px, cfg)
+			mu.Lock()
+			defer mu.Unlock()
+			if err != nil {
+				failed[px.Addr()] = err
+				return
+			}
+			px.Latency = latency
+			px.VerifiedAt = time.Now()
+			alive = append(alive, px)
+		}(p)
+	}
+	wg.Wait()
+	if ctx.Err() != nil {
+		return
+	}
+
+	pool.RecordChecks(stale, alive, failed)
+	pool.Reverified(stale, alive)
+	infof("[main] re-checked %d stale proxies, %d still alive", len(stale), len(alive))
 }
 
-// TriggerRefresh sends a manual refresh signal (non-blocking).
-func TriggerRefresh() {
+// TriggerRefresh sends a manual refresh signal (non-blocking). The
+// returned channel is closed once a refresh started after this call
+// has finished; callers that don't care can ignore it.
+func TriggerRefresh() <-chan struct{} {
+	refreshMu.Lock()
+	triggerSeq++
+	w := refreshWaiter{seq: triggerSeq, done: make(chan struct{})}
+	refreshWaiters = append(refreshWaiters, w)
+	refreshMu.Unlock()
+
 	select {
 	case refreshChan <- struct{}{}:
 	default:
 		// already pending
 	}
+	return w.done
 }
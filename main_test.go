@@ -0,0 +1,30 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestScrapeAllCancel(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-r.Context().Done()
+	}))
+	t.Cleanup(srv.Close)
+	cfg := &Config{Format: FormatAuto, ScrapeTimeout: time.Minute, ScrapeClient: srv.Client()}
+	for range 3 {
+		cfg.Sources = append(cfg.Sources, NewSource(srv.URL, cfg))
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	time.AfterFunc(50*time.Millisecond, cancel)
+	start := time.Now()
+	if _, ok := scrapeAll(ctx, cfg, func(string) bool { return false }); ok {
+		t.Error("scrapeAll succeeded after cancel")
+	}
+	if d := time.Since(start); d > testTimeout {
+		t.Errorf("scrapeAll returned %s after cancel; want well under -scrape-timeout", d)
+	}
+}
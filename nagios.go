@@ -0,0 +1,109 @@
+package main
+
+import (
+	"crypto/tls"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+)
+
+// Nagios plugin exit codes, which are also the check states.
+const (
+	nagiosOK       = 0
+	nagiosWarning  = 1
+	nagiosCritical = 2
+	nagiosUnknown  = 3
+)
+
+var nagiosStates = [...]string{"OK", "WARNING", "CRITICAL", "UNKNOWN"}
+
+// nagiosLine rates a pool of size proxies against the thresholds:
+// CRITICAL at or below crit, WARNING below warn, OK otherwise. The line
+// carries perfdata in the plugin format, size=N;warn;crit;min.
+func nagiosLine(size, warn, crit int) (int, string) {
+	code := nagiosOK
+	switch {
+	case size <= crit:
+		code = nagiosCritical
+	case size < warn:
+		code = nagiosWarning
+	}
+	return code, fmt.Sprintf("POOL %s - %d proxies | size=%d;%d;%d;0", nagiosStates[code], size, size, warn, crit)
+}
+
+// handleNagios serves the check line for check_http and friends. The
+// thresholds default to -nagios-warn and -nagios-crit and can be
+// overridden with ?warn= and ?crit=.
+func (s *StatusServer) handleNagios(w http.ResponseWriter, r *http.Request) {
+	warn, crit := s.cfg.NagiosWarn, s.cfg.NagiosCrit
+	if v := r.URL.Query().Get("warn"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil {
+			http.Error(w, "invalid warn", http.StatusBadRequest)
+			return
+		}
+		warn = n
+	}
+	if v := r.URL.Query().Get("crit"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil {
+			http.Error(w, "invalid crit", http.StatusBadRequest)
+			return
+		}
+		crit = n
+	}
+	_, line := nagiosLine(s.pool.Size(), warn, crit)
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	fmt.Fprintln(w, line)
+}
+
+// runNagiosCheck is -nagios-check: it asks the instance running with
+// the same -status flags for its check line, prints it and returns the
+// plugin exit code. An unreachable dashboard is UNKNOWN.
+func runNagiosCheck(cfg *Config) int {
+	host, port, _ := net.SplitHostPort(cfg.StatusAddr)
+	if ip := net.ParseIP(host); host == "" || ip != nil && ip.IsUnspecified() {
+		host = "127.0.0.1"
+	}
+	u := url.URL{
+		Scheme:   cfg.StatusScheme(),
+		Host:     net.JoinHostPort(host, port),
+		Path:     "/api/nagios",
+		RawQuery: url.Values{"warn": {strconv.Itoa(cfg.NagiosWarn)}, "crit": {strconv.Itoa(cfg.NagiosCrit)}}.Encode(),
+	}
+	client := &http.Client{Timeout: cfg.CheckTimeout}
+	if cfg.StatusSelfSigned {
+		// Nothing to verify a generated cert against
+		client.Transport = &http.Transport{TLSClientConfig: &tls.Config{InsecureSkipVerify: true}}
+	}
+	req, _ := http.NewRequest(http.MethodGet, u.String(), nil)
+	if cfg.StatusUser != "" {
+		req.SetBasicAuth(cfg.StatusUser, cfg.StatusPass)
+	}
+
+	resp, err := client.Do(req)
+	if err != nil {
+		fmt.Printf("POOL UNKNOWN - %v\n", err)
+		return nagiosUnknown
+	}
+	defer resp.Body.Close()
+	body, _ := io.ReadAll(io.LimitReader(resp.Body, 4096))
+	line := strings.TrimSpace(string(body))
+	if resp.StatusCode != http.StatusOK {
+		fmt.Printf("POOL UNKNOWN - %s: %s\n", resp.Status, line)
+		return nagiosUnknown
+	}
+	fmt.Println(line)
+	if f := strings.Fields(line); len(f) > 1 {
+		for code, state := range nagiosStates {
+			if f[1] == state {
+				return code
+			}
+		}
+	}
+	return nagiosUnknown
+}
@@ -0,0 +1,70 @@
+package main
+
+// Operator pins. A pinned proxy is never rotated away from by
+// -rotate-interval or a sticky retry, is exempt from eviction on relay
+// failures, and wins subnet dedupe on Update; it is only dropped when
+// it fails a health check or is removed. While any proxy is pinned,
+// per-connection strategies pick among the pinned ones only.
+
+// SetPinned pins or unpins the proxy at index. Pinning also makes it
+// the active proxy. Returns false if index is out of range.
+func (p *ProxyPool) SetPinned(index int, pinned bool) (Proxy, bool) {
+	defer p.lockTracked()()
+	if index < 0 || index >= len(p.proxies) {
+		return Proxy{}, false
+	}
+	px := p.proxies[index]
+	if pinned {
+		p.pinned[px.Addr()] = true
+		p.current = index
+		infof("[pool] pinned %s", px.Addr())
+	} else {
+		delete(p.pinned, px.Addr())
+		infof("[pool] unpinned %s", px.Addr())
+	}
+	p.notify()
+	return px, true
+}
+
+// UnpinAll clears every pin.
+func (p *ProxyPool) UnpinAll() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if len(p.pinned) == 0 {
+		return
+	}
+	p.pinned = make(map[string]bool)
+	infof("[pool] unpinned all proxies")
+	p.notify()
+}
+
+// Pinned returns the set of pinned addrs.
+func (p *ProxyPool) Pinned() map[string]bool {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	out := make(map[string]bool, len(p.pinned))
+	for addr := range p.pinned {
+		out[addr] = true
+	}
+	return out
+}
+
+// Rotate is SwitchNext for automatic rotation: it stays put while the
+// active proxy is pinned.
+func (p *ProxyPool) Rotate() (Proxy, bool) {
+	defer p.lockTracked()()
+	if len(p.proxies) == 0 {
+		return Proxy{}, false
+	}
+	if !p.pinned[p.proxies[p.current].Addr()] {
+		p.current = (p.current + 1) % len(p.proxies)
+		p.notify()
+	}
+	return p.proxies[p.current], true
+}
+
+// skipUnpinnedLocked reports whether per-connection selection should
+// pass over addr because other proxies are pinned. Caller holds p.mu.
+func (p *ProxyPool) skipUnpinnedLocked(addr string) bool {
+	return len(p.pinned) > 0 && !p.pinned[addr]
+}
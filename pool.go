@@ -1,89 +1,858 @@
 package main
 
 import (
-	"log"
+	"fmt"
+	"math/rand"
+	"net"
+	"sort"
+	"strings"
 	"sync"
+	"sync/atomic"
+	"time"
 )
 
+// Strategy controls how the pool picks an upstream per connection.
+type Strategy int
+
+const (
+	StrategySticky     Strategy = iota // keep the current proxy until failure
+	StrategyRoundRobin                 // advance on every connection
+	StrategyRandom                     // pick uniformly per connection
+	StrategyWeighted                   // pick by success rate / latency
+)
+
+// ParseStrategy parses a -strategy flag value.
+func ParseStrategy(s string) (Strategy, error) {
+	switch s {
+	case "sticky":
+		return StrategySticky, nil
+	case "round-robin":
+		return StrategyRoundRobin, nil
+	case "random":
+		return StrategyRandom, nil
+	case "weighted":
+		return StrategyWeighted, nil
+	}
+	return 0, fmt.Errorf("unknown strategy %q", s)
+}
+
+func (s Strategy) String() string {
+	switch s {
+	case StrategyRoundRobin:
+		return "round-robin"
+	case StrategyRandom:
+		return "random"
+	case StrategyWeighted:
+		return "weighted"
+	default:
+		return "sticky"
+	}
+}
+
 // ProxyPool holds a list of verified proxies.
-// It picks one "current" proxy and sticks with it until failure.
+// In sticky mode it picks one "current" proxy and sticks with it until
+// failure; other strategies pick a proxy per connection via Next.
 type ProxyPool struct {
-	mu      sync.RWMutex
+	mu        sync.RWMutex
+	proxies   []Proxy
+	current   int            // index of the current active proxy
+	failures  map[string]int // consecutive relay failures by addr
+	stats     map[string]*ProxyStats
+	blacklist map[string]bool // removed by the operator, never re-added
+	pinned    map[string]bool // pinned by the operator, see pin.go
+	strategy  Strategy
+	subnet    int            // dedupe by IPv4 /subnet on Update; 0 disables
+	priority  map[string]int // -priority-list rank by addr, sorted first
+
+	// -country-weights by upper-cased code or name, see scoreLocked;
+	// nil ranks by latency alone
+	weights map[string]float64
+
+	// Draws for WeightedNext, under p.mu; tests seed their own
+	rng *rand.Rand
+
+	// Concurrent relays per proxy addr, capped at maxPerProxy (0 = no cap)
+	inUse       map[string]int
+	maxPerProxy int
+
+	// Circuit breakers: breakerFailures consecutive failures skip a
+	// proxy until openUntil, then one trial connection decides
+	breakerFailures int
+	breakerCooldown time.Duration
+	openUntil       map[string]time.Time
+	trial           map[string]bool // half-open trial in flight
+
+	// Failover damping: a failed connection doesn't move the active
+	// proxy again within switchCooldown of the last switch
+	lastSwitch     time.Time
+	switchCooldown time.Duration
+
+	// Session affinity: client IP -> pinned proxy addr
+	affinity    map[string]affinityEntry
+	affinityTTL time.Duration
+
+	// proxies and current as of the last change, for lock-free reads
+	view atomic.Pointer[poolView]
+
+	// Change subscribers, signalled when the list or active proxy changes
+	subs map[chan struct{}]struct{}
+
+	switchHooks []func(old, new Proxy)
+	eventHooks  []func(PoolEvent)
+	pending     []PoolEvent // queued under p.mu, delivered on unlock
+}
+
+// poolView is a snapshot of the list and the active index, republished
+// by every change under p.mu so the hot read paths (Current, Size, All)
+// never wait on the lock, e.g. behind an Update. A published slice is
+// never written again: changes build a new one or append past its end.
+type poolView struct {
 	proxies []Proxy
-	current int // index of the current active proxy
+	current int
+}
+
+// publishLocked stores the current list and index as p.view. Caller
+// holds p.mu.
+func (p *ProxyPool) publishLocked() {
+	p.view.Store(&poolView{proxies: p.proxies, current: p.current})
+}
+
+type affinityEntry struct {
+	addr    string
+	expires time.Time
+}
+
+// maxFailures is how many consecutive relay failures evict a proxy.
+const maxFailures = 3
+
+func NewProxyPool(cfg *Config) *ProxyPool {
+	p := &ProxyPool{
+		failures:    make(map[string]int),
+		stats:       make(map[string]*ProxyStats),
+		blacklist:   make(map[string]bool),
+		pinned:      make(map[string]bool),
+		priority:    make(map[string]int, len(cfg.Priority)),
+		strategy:    cfg.Strategy,
+		subnet:      cfg.DedupeSubnet,
+		weights:     cfg.CountryWeights,
+		rng:         rand.New(rand.NewSource(time.Now().UnixNano())),
+		inUse:       make(map[string]int),
+		maxPerProxy: cfg.MaxPerProxy,
+
+		breakerFailures: cfg.BreakerFailures,
+		breakerCooldown: cfg.BreakerCooldown,
+		openUntil:       make(map[string]time.Time),
+		trial:           make(map[string]bool),
+		affinity:        make(map[string]affinityEntry),
+		affinityTTL:     cfg.AffinityTTL,
+		switchCooldown:  cfg.SwitchCooldown,
+		subs:            make(map[chan struct{}]struct{}),
+	}
+	p.publishLocked()
+	for i, addr := range cfg.Priority {
+		if _, dup := p.priority[addr]; !dup {
+			p.priority[addr] = i
+		}
+	}
+	return p
 }
 
-func NewProxyPool() *ProxyPool {
-	return &ProxyPool{}
+// Subscribe returns a channel that receives a signal after the pool
+// changes (refresh, add, remove, switch, eviction, a circuit opening or
+// closing), and a func to stop.
+// Signals coalesce: a slow reader sees one pending signal, not a backlog.
+// Per-connection moves by round-robin and random don't signal.
+func (p *ProxyPool) Subscribe() (<-chan struct{}, func()) {
+	ch := make(chan struct{}, 1)
+	p.mu.Lock()
+	p.subs[ch] = struct{}{}
+	p.mu.Unlock()
+	return ch, func() {
+		p.mu.Lock()
+		delete(p.subs, ch)
+		p.mu.Unlock()
+	}
+}
+
+// notify signals subscribers without blocking. Caller holds p.mu.
+func (p *ProxyPool) notify() {
+	for ch := range p.subs {
+		select {
+		case ch <- struct{}{}:
+		default:
+		}
+	}
+}
+
+// OnSwitch registers fn to run whenever the active proxy changes through
+// Update, Add, SwitchNext, SwitchTo, eviction or Remove. new is the
+// zero Proxy if the pool emptied. Hooks run after the pool is unlocked,
+// so they may call back into it. Per-connection moves by round-robin
+// and random don't count.
+func (p *ProxyPool) OnSwitch(fn func(old, new Proxy)) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.switchHooks = append(p.switchHooks, fn)
 }
 
-// Update replaces the proxy list with new verified proxies.
-// Resets current to 0 (pick the first one).
-func (p *ProxyPool) Update(proxies []Proxy) {
+// OnEvent registers fn to receive proxy_added and proxy_evicted events
+// from pool changes, and anything passed to Emit. Like OnSwitch hooks,
+// it runs after the pool is unlocked.
+func (p *ProxyPool) OnEvent(fn func(PoolEvent)) {
 	p.mu.Lock()
 	defer p.mu.Unlock()
+	p.eventHooks = append(p.eventHooks, fn)
+}
+
+// Emit delivers ev to the OnEvent hooks, for events that happen outside
+// the pool such as a finished scrape. Time and Total are filled in.
+func (p *ProxyPool) Emit(ev PoolEvent) {
+	p.mu.Lock()
+	p.emitLocked(ev)
+	events, hooks := p.pending, p.eventHooks
+	p.pending = nil
+	p.mu.Unlock()
+	for _, ev := range events {
+		for _, fn := range hooks {
+			fn(ev)
+		}
+	}
+}
+
+// emitLocked queues ev for the OnEvent hooks. Caller holds p.mu and
+// must release it through lockTracked or Emit, which deliver the queue.
+func (p *ProxyPool) emitLocked(ev PoolEvent) {
+	ev.Time = time.Now()
+	ev.Total = len(p.proxies)
+	p.pending = append(p.pending, ev)
+}
+
+// lockTracked locks the pool and returns the matching unlock, which
+// delivers queued events and runs the OnSwitch hooks if the active
+// proxy changed in between:
+//
+//	defer p.lockTracked()()
+func (p *ProxyPool) lockTracked() func() {
+	p.mu.Lock()
+	old := p.activeLocked()
+	return func() {
+		p.publishLocked()
+		cur := p.activeLocked()
+		if cur.Addr() != old.Addr() {
+			p.lastSwitch = time.Now()
+		}
+		hooks := p.switchHooks
+		events, eventHooks := p.pending, p.eventHooks
+		p.pending = nil
+		p.mu.Unlock()
+		for _, ev := range events {
+			for _, fn := range eventHooks {
+				fn(ev)
+			}
+		}
+		if cur.Addr() == old.Addr() {
+			return
+		}
+		for _, fn := range hooks {
+			fn(old, cur)
+		}
+	}
+}
+
+// activeLocked returns the active proxy, or the zero Proxy if the pool
+// is empty. Caller holds p.mu.
+func (p *ProxyPool) activeLocked() Proxy {
+	if len(p.proxies) == 0 {
+		return Proxy{}
+	}
+	return p.proxies[p.current]
+}
+
+// Strategy returns the pool's selection strategy.
+func (p *ProxyPool) Strategy() Strategy {
+	return p.strategy
+}
+
+// Update merges a freshly verified batch into the pool, sorted with
+// -priority-list entries first and the rest by lessLocked's score.
+// Proxies in the batch are added or replace their old entry; pooled
+// proxies missing from it are kept unless failed says they failed a
+// re-check, so a proxy survives as long as it still verifies, even if
+// it dropped off the source list. If the active proxy survives it stays
+// active, unless it's unpinned and a priority proxy is now available;
+// otherwise the first pinned one, or the first of all, takes over.
+// Stats are kept separately by addr and carry over automatically.
+func (p *ProxyPool) Update(proxies []Proxy, failed map[string]error) {
+	defer p.lockTracked()()
+
+	fresh := make([]Proxy, 0, len(proxies)+len(p.proxies))
+	batch := make(map[string]bool, len(proxies))
+	for _, px := range proxies {
+		if !p.blacklist[px.Addr()] {
+			fresh = append(fresh, px)
+			batch[px.Addr()] = true
+		}
+	}
+	for _, px := range p.proxies {
+		if !batch[px.Addr()] && failed[px.Addr()] == nil {
+			fresh = append(fresh, px)
+		}
+	}
+	proxies = fresh
+	sort.SliceStable(proxies, func(i, j int) bool {
+		return p.lessLocked(proxies[i], proxies[j])
+	})
+	if p.subnet > 0 {
+		proxies = dedupeSubnet(proxies, p.subnet, p.pinned)
+	}
+
+	var activeAddr string
+	if len(p.proxies) > 0 {
+		activeAddr = p.proxies[p.current].Addr()
+	}
+
+	prev := make(map[string]bool, len(p.proxies))
+	tags := make(map[string][]string)
+	for _, px := range p.proxies {
+		prev[px.Addr()] = true
+		if len(px.Tags) > 0 {
+			tags[px.Addr()] = px.Tags
+		}
+	}
 	p.proxies = proxies
+	for i, px := range proxies {
+		// A scraped copy of a tagged proxy keeps its tags
+		if len(px.Tags) == 0 {
+			proxies[i].Tags = tags[px.Addr()]
+		}
+		if !prev[px.Addr()] {
+			p.emitLocked(PoolEvent{Type: EventProxyAdded, Addr: px.Addr()})
+		}
+		delete(prev, px.Addr())
+	}
+	for addr := range prev {
+		delete(p.pinned, addr)
+		p.emitLocked(PoolEvent{Type: EventProxyEvicted, Addr: addr, Reason: "refresh"})
+	}
 	p.current = 0
-	if len(proxies) > 0 {
-		log.Printf("[pool] active proxy: %s (%s %s)", proxies[0].Addr(), proxies[0].Country, proxies[0].City)
+	// Everything here just passed a check, so failures and open circuits start over
+	p.failures = make(map[string]int)
+	p.openUntil = make(map[string]time.Time)
+	p.trial = make(map[string]bool)
+	kept := false
+	for i, px := range proxies {
+		if px.Addr() == activeAddr {
+			p.current, kept = i, true
+			break
+		}
+	}
+	// A priority proxy takes over from a non-priority, unpinned one
+	if kept && len(proxies) > 0 && !p.pinned[activeAddr] {
+		_, activeRanked := p.priority[activeAddr]
+		if _, frontRanked := p.priority[proxies[0].Addr()]; frontRanked && !activeRanked {
+			p.current = 0
+		}
+	}
+	// A new active proxy comes from the pins, if any survived
+	if !kept {
+		for i, px := range proxies {
+			if p.pinned[px.Addr()] {
+				p.current = i
+				break
+			}
+		}
 	}
+	p.notify()
 }
 
-// Current returns the current active proxy.
-func (p *ProxyPool) Current() (Proxy, bool) {
+// lessLocked orders proxies on Update: -priority-list entries first, in
+// list order, then the rest by score, highest first. Caller holds p.mu.
+func (p *ProxyPool) lessLocked(a, b Proxy) bool {
+	ra, aok := p.priority[a.Addr()]
+	rb, bok := p.priority[b.Addr()]
+	switch {
+	case aok && bok:
+		return ra < rb
+	case aok != bok:
+		return aok
+	}
+	if p.weights == nil {
+		return a.Latency < b.Latency
+	}
+	return p.scoreLocked(a) > p.scoreLocked(b)
+}
+
+// scoreLocked ranks a proxy by its -country-weights weight over its
+// latency, so a preferred country floats up unless it is slower by more
+// than the ratio of the weights: at 1.0 vs 0.5 it wins up to twice the
+// latency. Without weights this is the plain latency sort. Caller
+// holds p.mu.
+func (p *ProxyPool) scoreLocked(px Proxy) float64 {
+	w, ok := p.weights[strings.ToUpper(px.CountryCode)]
+	if !ok || px.CountryCode == "" {
+		w, ok = p.weights[strings.ToUpper(px.Country)]
+	}
+	if !ok {
+		w, ok = p.weights["*"]
+	}
+	if !ok {
+		w = defaultCountryWeight
+	}
+	// Unmeasured latency would divide by zero; count it as 1ms
+	return w / max(px.Latency, time.Millisecond).Seconds()
+}
+
+// dedupeSubnet keeps the first proxy seen in each IPv4 /bits network,
+// so with a sorted list the best-ranked one wins, unless another
+// one there is pinned. Entries that aren't IPv4 literals are keyed by
+// host, collapsing ports on one host.
+func dedupeSubnet(proxies []Proxy, bits int, pinned map[string]bool) []Proxy {
+	mask := net.CIDRMask(bits, 32)
+	subnet := func(px Proxy) string {
+		if ip := net.ParseIP(px.IP).To4(); ip != nil {
+			return ip.Mask(mask).String()
+		}
+		return px.IP
+	}
+	seen := make(map[string]bool)
+	for _, px := range proxies {
+		if pinned[px.Addr()] {
+			seen[subnet(px)] = true
+		}
+	}
+	kept := proxies[:0]
+	for _, px := range proxies {
+		key := subnet(px)
+		if !pinned[px.Addr()] {
+			if seen[key] {
+				continue
+			}
+			seen[key] = true
+		}
+		kept = append(kept, px)
+	}
+	if dropped := len(proxies) - len(kept); dropped > 0 {
+		infof("[pool] dropped %d proxies sharing a /%d subnet", dropped, bits)
+	}
+	return kept
+}
+
+// Add appends a proxy to the pool. Returns false if its address is
+// already present. Adding a blacklisted proxy lifts the blacklist,
+// since the operator asked for it explicitly.
+func (p *ProxyPool) Add(px Proxy) bool {
+	defer p.lockTracked()()
+	for _, existing := range p.proxies {
+		if existing.Addr() == px.Addr() {
+			return false
+		}
+	}
+	delete(p.blacklist, px.Addr())
+	p.proxies = append(p.proxies, px)
+	infof("[pool] added %s (%s %s), %d total", px.Addr(), px.Country, px.City, len(p.proxies))
+	p.emitLocked(PoolEvent{Type: EventProxyAdded, Addr: px.Addr()})
+	p.notify()
+	return true
+}
+
+// Contains reports whether addr is in the pool.
+func (p *ProxyPool) Contains(addr string) bool {
 	p.mu.RLock()
 	defer p.mu.RUnlock()
+	for _, px := range p.proxies {
+		if px.Addr() == addr {
+			return true
+		}
+	}
+	return false
+}
+
+// Current returns the current active proxy.
+func (p *ProxyPool) Current() (Proxy, bool) {
+	v := p.view.Load()
+	if len(v.proxies) == 0 {
+		return Proxy{}, false
+	}
+	return v.proxies[v.current], true
+}
+
+// Next picks the proxy for a new connection according to the strategy.
+// Sticky returns the current proxy; round-robin and random move the
+// current index without logging, since they change on every call.
+func (p *ProxyPool) Next() (Proxy, bool) {
+	switch p.strategy {
+	case StrategySticky:
+		return p.Current()
+	case StrategyWeighted:
+		return p.WeightedNext()
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
 	if len(p.proxies) == 0 {
 		return Proxy{}, false
 	}
+	defer p.publishLocked()
+	// Pins are always pool members, so both loops terminate
+	if p.strategy == StrategyRandom {
+		for p.current = rand.Intn(len(p.proxies)); p.skipUnpinnedLocked(p.proxies[p.current].Addr()); {
+			p.current = rand.Intn(len(p.proxies))
+		}
+	} else {
+		for p.current = (p.current + 1) % len(p.proxies); p.skipUnpinnedLocked(p.proxies[p.current].Addr()); {
+			p.current = (p.current + 1) % len(p.proxies)
+		}
+	}
 	return p.proxies[p.current], true
 }
 
-// SwitchNext moves to the next proxy in the list. Returns the new proxy.
-func (p *ProxyPool) SwitchNext() (Proxy, bool) {
+// Affinity returns the proxy pinned to client, if session affinity is
+// enabled, the pin hasn't expired and the proxy is still in the pool.
+// A hit extends the pin by another TTL.
+func (p *ProxyPool) Affinity(client string) (Proxy, bool) {
+	if p.affinityTTL <= 0 || client == "" {
+		return Proxy{}, false
+	}
 	p.mu.Lock()
 	defer p.mu.Unlock()
+	a, ok := p.affinity[client]
+	if !ok || time.Now().After(a.expires) {
+		return Proxy{}, false
+	}
+	for _, px := range p.proxies {
+		if px.Addr() == a.addr {
+			a.expires = time.Now().Add(p.affinityTTL)
+			p.affinity[client] = a
+			return px, true
+		}
+	}
+	// Pinned proxy was evicted
+	delete(p.affinity, client)
+	return Proxy{}, false
+}
+
+// Pin maps client to addr for the affinity TTL. Expired pins are
+// pruned here so the map stays bounded by active clients.
+func (p *ProxyPool) Pin(client, addr string) {
+	if p.affinityTTL <= 0 || client == "" {
+		return
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	now := time.Now()
+	for k, a := range p.affinity {
+		if now.After(a.expires) {
+			delete(p.affinity, k)
+		}
+	}
+	p.affinity[client] = affinityEntry{addr: addr, expires: now.Add(p.affinityTTL)}
+}
+
+// SwitchNext moves to the next proxy in the list. Returns the new proxy.
+func (p *ProxyPool) SwitchNext() (Proxy, bool) {
+	defer p.lockTracked()()
 	if len(p.proxies) == 0 {
 		return Proxy{}, false
 	}
 	p.current = (p.current + 1) % len(p.proxies)
 	px := p.proxies[p.current]
-	log.Printf("[pool] switched to: %s (%s %s)", px.Addr(), px.Country, px.City)
+	p.notify()
 	return px, true
 }
 
+// Failover moves a sticky pool off a proxy a connection just failed
+// on. Within -switch-cooldown of the last switch it leaves the active
+// proxy alone and returns the first one from it on that isn't in skip,
+// so a burst of connections failing together moves the pool once
+// instead of cascading through it. A pinned active proxy holds, as
+// with Rotate.
+func (p *ProxyPool) Failover(skip map[string]bool) (Proxy, bool) {
+	defer p.lockTracked()()
+	if len(p.proxies) == 0 {
+		return Proxy{}, false
+	}
+	if time.Since(p.lastSwitch) < p.switchCooldown {
+		for i := range p.proxies {
+			px := p.proxies[(p.current+i)%len(p.proxies)]
+			if !skip[px.Addr()] {
+				return px, true
+			}
+		}
+		return p.proxies[p.current], true
+	}
+	if !p.pinned[p.proxies[p.current].Addr()] {
+		p.current = (p.current + 1) % len(p.proxies)
+		p.notify()
+	}
+	return p.proxies[p.current], true
+}
+
 // SwitchTo switches to a specific proxy by index. Returns the proxy.
 func (p *ProxyPool) SwitchTo(index int) (Proxy, bool) {
-	p.mu.Lock()
-	defer p.mu.Unlock()
+	defer p.lockTracked()()
 	if index < 0 || index >= len(p.proxies) {
 		return Proxy{}, false
 	}
 	p.current = index
 	px := p.proxies[p.current]
-	log.Printf("[pool] switched to: %s (%s %s)", px.Addr(), px.Country, px.City)
+	p.notify()
 	return px, true
 }
 
-// CurrentIndex returns the current active index.
-func (p *ProxyPool) CurrentIndex() int {
+// Acquire takes a relay slot on px. If px is at -max-per-proxy or its
+// circuit is open, it takes one on the least-loaded usable proxy
+// carrying tag instead (the fastest, on a tie) and returns that. It
+// fails only when no such proxy is usable. Callers Release the returned proxy's addr when
+// done, and report the outcome with MarkSuccess or MarkFailure, which
+// settles a half-open trial.
+func (p *ProxyPool) Acquire(px Proxy, tag string) (Proxy, bool) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	now := time.Now()
+	usable := func(addr string) bool {
+		return p.usableLocked(addr, now) && (p.maxPerProxy <= 0 || p.inUse[addr] < p.maxPerProxy)
+	}
+	if !usable(px.Addr()) {
+		best := -1
+		for i, cand := range p.proxies {
+			if cand.HasTag(tag) && usable(cand.Addr()) && (best < 0 || p.inUse[cand.Addr()] < p.inUse[p.proxies[best].Addr()]) {
+				best = i
+			}
+		}
+		if best < 0 {
+			return px, false
+		}
+		px = p.proxies[best]
+	}
+	p.claimLocked(px.Addr(), now)
+	p.inUse[px.Addr()]++
+	return px, true
+}
+
+// Release frees a slot taken by Acquire. A half-open trial that ended
+// without a verdict frees the trial for the next connection.
+func (p *ProxyPool) Release(addr string) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	delete(p.trial, addr)
+	if p.inUse[addr] <= 1 {
+		delete(p.inUse, addr)
+		return
+	}
+	p.inUse[addr]--
+}
+
+// InUse returns the number of active relays per proxy addr.
+func (p *ProxyPool) InUse() map[string]int {
 	p.mu.RLock()
 	defer p.mu.RUnlock()
-	return p.current
+	out := make(map[string]int, len(p.inUse))
+	for addr, n := range p.inUse {
+		out[addr] = n
+	}
+	return out
 }
 
-// Size returns the current number of proxies in the pool.
-func (p *ProxyPool) Size() int {
+// SwitchToFastest makes the proxy with the lowest measured latency
+// current. Blacklisted proxies are never in the list, so they can't be
+// picked. Without any latency data it behaves like SwitchNext.
+func (p *ProxyPool) SwitchToFastest() (Proxy, bool) {
+	defer p.lockTracked()()
+	if len(p.proxies) == 0 {
+		return Proxy{}, false
+	}
+	best := -1
+	for i, px := range p.proxies {
+		if px.Latency > 0 && (best < 0 || px.Latency < p.proxies[best].Latency) {
+			best = i
+		}
+	}
+	if best < 0 {
+		best = (p.current + 1) % len(p.proxies)
+	}
+	p.current = best
+	px := p.proxies[p.current]
+	p.notify()
+	return px, true
+}
+
+// MarkFailure records a relay failure for addr, with err as its last
+// error. Once the proxy reaches maxFailures consecutive failures it is
+// evicted from the pool. Returns true if the proxy was evicted.
+func (p *ProxyPool) MarkFailure(addr string, err error) bool {
+	defer p.lockTracked()()
+	p.statsFor(addr).Checks++
+	p.noteErrorLocked(addr, err)
+	p.failures[addr]++
+	if p.failures[addr] < maxFailures || p.pinned[addr] {
+		// Pinned proxies only leave on a failed health check
+		p.tripLocked(addr)
+		return false
+	}
+	delete(p.failures, addr)
+	delete(p.openUntil, addr)
+	delete(p.trial, addr)
+
+	for i, px := range p.proxies {
+		if px.Addr() != addr {
+			continue
+		}
+		p.removeAt(i)
+		infof("[pool] evicted %s after %d failures, %d left, last error: %v", addr, maxFailures, len(p.proxies), err)
+		p.emitLocked(PoolEvent{Type: EventProxyEvicted, Addr: addr, Reason: "failures", Error: p.stats[addr].LastError})
+		p.notify()
+		return true
+	}
+	return false
+}
+
+// removeAt drops the proxy at index i, keeping current pointing at the
+// same proxy, or at the next one if the active proxy was removed.
+// Caller holds p.mu.
+func (p *ProxyPool) removeAt(i int) {
+	delete(p.pinned, p.proxies[i].Addr())
+	p.proxies = append(p.proxies[:i:i], p.proxies[i+1:]...)
+	if i < p.current {
+		p.current--
+	}
+	if p.current >= len(p.proxies) {
+		p.current = 0
+	}
+}
+
+// Remove deletes the proxy at index from the pool, optionally
+// blacklisting it so later refreshes won't add it back.
+func (p *ProxyPool) Remove(index int, blacklist bool) (Proxy, bool) {
+	defer p.lockTracked()()
+	if index < 0 || index >= len(p.proxies) {
+		return Proxy{}, false
+	}
+	px := p.proxies[index]
+	p.removeAt(index)
+	if blacklist {
+		p.blacklist[px.Addr()] = true
+	}
+	infof("[pool] removed %s (blacklisted: %v), %d left", px.Addr(), blacklist, len(p.proxies))
+	p.emitLocked(PoolEvent{Type: EventProxyEvicted, Addr: px.Addr(), Reason: "removed"})
+	p.notify()
+	return px, true
+}
+
+// IndexOf returns the index of addr in the pool, or -1.
+func (p *ProxyPool) IndexOf(addr string) int {
 	p.mu.RLock()
 	defer p.mu.RUnlock()
-	return len(p.proxies)
+	for i, px := range p.proxies {
+		if px.Addr() == addr {
+			return i
+		}
+	}
+	return -1
+}
+
+// Blacklisted reports whether addr was removed with blacklisting.
+func (p *ProxyPool) Blacklisted(addr string) bool {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	return p.blacklist[addr]
+}
+
+// MarkSuccess resets the failure counter for addr.
+func (p *ProxyPool) MarkSuccess(addr string) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	delete(p.failures, addr)
+	p.resetLocked(addr)
+	st := p.statsFor(addr)
+	st.Checks++
+	st.Successes++
+	st.LastSeen = time.Now()
+}
+
+// CurrentIndex returns the current active index.
+func (p *ProxyPool) CurrentIndex() int {
+	return p.view.Load().current
+}
+
+// Size returns the current number of proxies in the pool.
+func (p *ProxyPool) Size() int {
+	return len(p.view.Load().proxies)
 }
 
 // All returns a copy of all proxies in the pool.
 func (p *ProxyPool) All() []Proxy {
+	v := p.view.Load()
+	result := make([]Proxy, len(v.proxies))
+	copy(result, v.proxies)
+	return result
+}
+
+// Sample returns up to n proxies other than exclude, picked at random
+// among those with a closed circuit.
+func (p *ProxyPool) Sample(n int, exclude string) []Proxy {
 	p.mu.RLock()
 	defer p.mu.RUnlock()
-	result := make([]Proxy, len(p.proxies))
-	copy(result, p.proxies)
-	return result
+	var out []Proxy
+	for _, i := range rand.Perm(len(p.proxies)) {
+		if len(out) == n {
+			break
+		}
+		if px := p.proxies[i]; px.Addr() != exclude && p.breakerLocked(px.Addr(), time.Now()) == BreakerClosed {
+			out = append(out, px)
+		}
+	}
+	return out
+}
+
+// Stale returns the proxies last verified more than ttl ago.
+func (p *ProxyPool) Stale(ttl time.Duration) []Proxy {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	cutoff := time.Now().Add(-ttl)
+	var stale []Proxy
+	for _, px := range p.proxies {
+		if px.VerifiedAt.Before(cutoff) {
+			stale = append(stale, px)
+		}
+	}
+	return stale
+}
+
+// Reverified applies a re-check of checked: proxies in alive get their
+// new latency, geo and VerifiedAt, the rest are evicted. Order is kept so
+// the active proxy doesn't move.
+func (p *ProxyPool) Reverified(checked, alive []Proxy) {
+	defer p.lockTracked()()
+	passed := make(map[string]Proxy, len(alive))
+	for _, px := range alive {
+		passed[px.Addr()] = px
+	}
+	failed := make(map[string]bool, len(checked))
+	for _, px := range checked {
+		if _, ok := passed[px.Addr()]; !ok {
+			failed[px.Addr()] = true
+		}
+	}
+
+	// Copy first: the published view may still be reading the old slice
+	p.proxies = append([]Proxy(nil), p.proxies...)
+	changed := false
+	for i := 0; i < len(p.proxies); i++ {
+		addr := p.proxies[i].Addr()
+		if px, ok := passed[addr]; ok {
+			p.proxies[i].Latency = px.Latency
+			p.proxies[i].VerifiedAt = px.VerifiedAt
+			p.proxies[i].Country, p.proxies[i].CountryCode, p.proxies[i].City = px.Country, px.CountryCode, px.City
+			changed = true
+		} else if failed[addr] {
+			p.removeAt(i)
+			i--
+			infof("[pool] evicted %s, re-check failed, %d left", addr, len(p.proxies))
+			p.emitLocked(PoolEvent{Type: EventProxyEvicted, Addr: addr, Reason: "recheck", Error: p.statsFor(addr).LastError})
+			changed = true
+		}
+	}
+	if changed {
+		p.notify()
+	}
 }
@@ -0,0 +1,108 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+)
+
+func testProxy(ip string, latency time.Duration) Proxy {
+	return Proxy{Scheme: SchemeSOCKS5, IP: ip, Port: "1080", Latency: latency}
+}
+
+func TestUpdateKeepsActiveProxy(t *testing.T) {
+	p := NewProxyPool(&Config{})
+	a := testProxy("10.0.0.1", 50*time.Millisecond)
+	b := testProxy("10.0.0.2", 100*time.Millisecond)
+	c := testProxy("10.0.0.3", 200*time.Millisecond)
+
+	p.Update([]Proxy{a}, nil)
+	p.RecordChecks([]Proxy{a}, []Proxy{a}, nil)
+	p.RecordChecks([]Proxy{a}, nil, map[string]error{a.Addr(): errors.New("timeout")})
+	if cur, ok := p.Current(); !ok || cur.Addr() != a.Addr() {
+		t.Fatalf("Current() = %v, %v; want %v", cur, ok, a)
+	}
+
+	// a dropped off the source list but wasn't re-checked as failed
+	p.Update([]Proxy{b, c}, nil)
+
+	if cur, ok := p.Current(); !ok || cur.Addr() != a.Addr() {
+		t.Errorf("Current() after Update = %v, %v; want %v", cur, ok, a)
+	}
+	st := p.Stats()[a.Addr()]
+	if st.Checks != 2 || st.Successes != 1 || st.LastError != "timeout" {
+		t.Errorf("stats for %s = %+v; want 2 checks, 1 success, last error timeout", a, st)
+	}
+	var got []string
+	for _, px := range p.All() {
+		got = append(got, px.Addr())
+	}
+	want := []string{a.Addr(), b.Addr(), c.Addr()}
+	if len(got) != len(want) {
+		t.Fatalf("pool = %v; want %v", got, want)
+	}
+	for i := range want {
+		if got[i] != want[i] {
+			t.Fatalf("pool = %v; want %v", got, want)
+		}
+	}
+}
+
+func TestUpdateDropsFailedProxy(t *testing.T) {
+	p := NewProxyPool(&Config{})
+	a := testProxy("10.0.0.1", 50*time.Millisecond)
+	b := testProxy("10.0.0.2", 100*time.Millisecond)
+
+	p.Update([]Proxy{a}, nil)
+	p.Update([]Proxy{b}, map[string]error{a.Addr(): errors.New("refused")})
+
+	all := p.All()
+	if len(all) != 1 || all[0].Addr() != b.Addr() {
+		t.Fatalf("pool = %v; want only %v", all, b)
+	}
+	if cur, ok := p.Current(); !ok || cur.Addr() != b.Addr() {
+		t.Errorf("Current() = %v, %v; want %v", cur, ok, b)
+	}
+}
+
+// BenchmarkPoolCurrentParallel reads the active proxy from every P while
+// another goroutine keeps refreshing the pool, the hot path of a busy
+// server during a scrape. Updates are paced so readers under a lock
+// get a turn at all; back to back they starve.
+func BenchmarkPoolCurrentParallel(b *testing.B) {
+	p := NewProxyPool(&Config{})
+	batch := make([]Proxy, 200)
+	for i := range batch {
+		batch[i] = testProxy(fmt.Sprintf("10.0.%d.%d", i/256, i%256), time.Duration(i+1)*time.Millisecond)
+	}
+	p.Update(batch, nil)
+
+	stop := make(chan struct{})
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for {
+			select {
+			case <-stop:
+				return
+			default:
+				p.Update(batch, nil)
+				time.Sleep(100 * time.Microsecond)
+			}
+		}
+	}()
+
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		for pb.Next() {
+			if _, ok := p.Current(); !ok {
+				b.Error("Current found no proxy")
+				return
+			}
+		}
+	})
+	b.StopTimer()
+	close(stop)
+	<-done
+}
@@ -0,0 +1,142 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// TokenBucket is a simple token-bucket rate limiter.
+type TokenBucket struct {
+	mu     sync.Mutex
+	tokens float64
+	burst  float64
+	rate   float64 // tokens per second
+	last   time.Time
+}
+
+// NewTokenBucket allows n events per interval with the given burst.
+func NewTokenBucket(n int, interval time.Duration, burst int) *TokenBucket {
+	return &TokenBucket{
+		tokens: float64(burst),
+		burst:  float64(burst),
+		rate:   float64(n) / interval.Seconds(),
+		last:   time.Now(),
+	}
+}
+
+// refill adds tokens earned since the last call. Caller holds mu.
+func (b *TokenBucket) refill(now time.Time) {
+	b.tokens += now.Sub(b.last).Seconds() * b.rate
+	if b.tokens > b.burst {
+		b.tokens = b.burst
+	}
+	b.last = now
+}
+
+// Allow takes a token if one is available, without blocking.
+func (b *TokenBucket) Allow() bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.refill(time.Now())
+	if b.tokens < 1 {
+		return false
+	}
+	b.tokens--
+	return true
+}
+
+// Wait blocks until a token is available or ctx is done. Tokens are
+// reserved up front, so concurrent waiters are served in order.
+func (b *TokenBucket) Wait(ctx context.Context) error {
+	b.mu.Lock()
+	b.refill(time.Now())
+	b.tokens--
+	wait := time.Duration(0)
+	if b.tokens < 0 {
+		wait = time.Duration(-b.tokens / b.rate * float64(time.Second))
+	}
+	b.mu.Unlock()
+
+	if wait == 0 {
+		return nil
+	}
+	t := time.NewTimer(wait)
+	defer t.Stop()
+	select {
+	case <-t.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// ClientLimiter gives each client IP its own TokenBucket, for
+// -client-rate. A bucket idle for a whole interval has refilled, so it
+// is dropped rather than kept; sweeps run at most once per interval.
+// A nil ClientLimiter allows everything.
+type ClientLimiter struct {
+	mu        sync.Mutex
+	n         int
+	interval  time.Duration
+	buckets   map[string]*TokenBucket
+	nextSweep time.Time
+}
+
+func NewClientLimiter(n int, interval time.Duration) *ClientLimiter {
+	return &ClientLimiter{n: n, interval: interval, buckets: make(map[string]*TokenBucket)}
+}
+
+// Allow takes a token from client's bucket if one is available.
+func (l *ClientLimiter) Allow(client string) bool {
+	if l == nil {
+		return true
+	}
+	l.mu.Lock()
+	now := time.Now()
+	if now.After(l.nextSweep) {
+		for ip, b := range l.buckets {
+			b.mu.Lock()
+			idle := now.Sub(b.last) >= l.interval
+			b.mu.Unlock()
+			if idle {
+				delete(l.buckets, ip)
+			}
+		}
+		l.nextSweep = now.Add(l.interval)
+	}
+	b, ok := l.buckets[client]
+	if !ok {
+		b = NewTokenBucket(l.n, l.interval, l.n)
+		l.buckets[client] = b
+	}
+	l.mu.Unlock()
+	return b.Allow()
+}
+
+// parseRate parses a rate like "10/min": a count per s, min or h
+// (or a Go duration such as 30s).
+func parseRate(v string) (int, time.Duration, error) {
+	count, unit, ok := strings.Cut(v, "/")
+	n, err := strconv.Atoi(strings.TrimSpace(count))
+	if !ok || err != nil || n < 1 {
+		return 0, 0, fmt.Errorf("expected N/unit such as 10/min, got %q", v)
+	}
+	var interval time.Duration
+	switch unit = strings.TrimSpace(unit); unit {
+	case "s", "sec", "second":
+		interval = time.Second
+	case "m", "min", "minute":
+		interval = time.Minute
+	case "h", "hour":
+		interval = time.Hour
+	default:
+		if interval, err = time.ParseDuration(unit); err != nil || interval <= 0 {
+			return 0, 0, fmt.Errorf("unknown rate unit %q", unit)
+		}
+	}
+	return n, interval, nil
+}
@@ -1,63 +1,237 @@
 package main
 
 import (
-	"fmt"
+	"bufio"
 	"io"
-	"log"
-	"net/http"
+	"net"
 	"regexp"
+	"strconv"
 	"strings"
+	"time"
 )
 
-var proxyRegex = regexp.MustCompile(`socks5://(\d{1,3}\.\d{1,3}\.\d{1,3}\.\d{1,3}):(\d+)`)
+// Optional user:pass@ before the address for authenticated proxies.
+// The host is an IPv4 dotted quad or a bracketed IPv6 literal. Any
+// bracketed host matches, so a bad literal is counted as invalid
+// rather than silently skipped.
+var proxyRegex = regexp.MustCompile(`(tls-socks5|socks5|http)://(?:([^:@\s/]+):([^@\s/]+)@)?(\d{1,3}\.\d{1,3}\.\d{1,3}\.\d{1,3}|\[[^\]\s/@]+\]):(\d+)`)
+
+var hostPortRegex = regexp.MustCompile(`^(\[[^\]\s]+\]|[A-Za-z0-9.-]+)[:,]\s*(\d{1,5})\b`)
+
+// Proxy list formats accepted by parseList.
+const (
+	FormatAuto     = "auto"     // scheme, falling back to hostport
+	FormatScheme   = "scheme"   // socks5:// or http://ip:port anywhere in the body
+	FormatHostPort = "hostport" // one host:port per line
+	FormatJSON     = "json"     // array of objects, see parseJSONList
+)
+
+// Upstream proxy protocols.
+const (
+	SchemeSOCKS5 = "socks5"
+	SchemeHTTP   = "http" // HTTP CONNECT
+)
 
 type Proxy struct {
-	IP      string
-	Port    string
-	Country string
-	City    string
+	Scheme      string // SchemeSOCKS5 (default when empty) or SchemeHTTP
+	TLS         bool   // speak to the proxy inside TLS, from tls-socks5://
+	IP          string
+	Port        string
+	User        string // optional upstream auth
+	Pass        string
+	Country     string
+	CountryCode string // ISO 3166-1 alpha-2, from geo lookup
+	City        string
+	Latency     time.Duration // measured by the health check
+	Anonymity   Anonymity     // from the echo check, if enabled
+	VerifiedAt  time.Time     // when the proxy last passed a health check
+	Tags        []string      // operator labels for tag-scoped selection
 }
 
+// Addr returns host:port, bracketing IPv6 hosts.
 func (p Proxy) Addr() string {
-	return p.IP + ":" + p.Port
+	return net.JoinHostPort(p.IP, p.Port)
 }
 
 func (p Proxy) String() string {
-	return fmt.Sprintf("socks5://%s:%s", p.IP, p.Port)
+	return p.listScheme() + "://" + p.Addr()
+}
+
+// unbracket strips the brackets from an IPv6 literal; it reports false
+// if a bracketed host isn't a valid IPv6 address.
+func unbracket(host string) (string, bool) {
+	if !strings.HasPrefix(host, "[") {
+		return host, true
+	}
+	ip := strings.Trim(host, "[]")
+	return ip, net.ParseIP(ip) != nil && strings.Contains(ip, ":")
+}
+
+// scheme returns the proxy protocol, defaulting to SOCKS5.
+func (p Proxy) scheme() string {
+	if p.Scheme == "" {
+		return SchemeSOCKS5
+	}
+	return p.Scheme
+}
+
+// listScheme is scheme as lists spell it, tls-socks5 for TLS proxies.
+func (p Proxy) listScheme() string {
+	if p.TLS {
+		return SchemeTLSSOCKS5
+	}
+	return p.scheme()
+}
+
+// parseList reads a proxy list line by line and parses it according
+// to format. JSON lists go to parseJSONList instead.
+func parseList(r io.Reader, format string) ([]Proxy, error) {
+	if format == FormatJSON {
+		return parseJSONList(r)
+	}
+	lp := newListParser(format)
+	sc := bufio.NewScanner(r)
+	sc.Buffer(make([]byte, 64*1024), maxScanLine)
+	sc.Split(scanProxyLines)
+	for sc.Scan() {
+		lp.parseLine(sc.Text())
+	}
+	if err := sc.Err(); err != nil {
+		return nil, err
+	}
+	proxies, invalid := lp.result()
+	if invalid > 0 {
+		warnf("[scraper] skipped %d entries with an invalid IP or port", invalid)
+	}
+	return proxies, nil
+}
+
+// maxScanLine bounds the memory used per line of a scraped list.
+const maxScanLine = 1 << 20
+
+// scanProxyLines is bufio.ScanLines, except that an over-long line
+// (minified HTML, say) is cut at the last byte that can't be part of a
+// proxy URL instead of failing the whole scrape.
+func scanProxyLines(data []byte, atEOF bool) (int, []byte, error) {
+	advance, token, err := bufio.ScanLines(data, atEOF)
+	if advance > 0 || err != nil || atEOF || len(data) < maxScanLine {
+		return advance, token, err
+	}
+	for i := len(data) - 1; i > 0; i-- {
+		if !isProxyURLByte(data[i]) {
+			return i + 1, data[:i], nil
+		}
+	}
+	return len(data), data, nil
+}
+
+func isProxyURLByte(c byte) bool {
+	return c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' ||
+		strings.IndexByte(".:/@_-%[]", c) >= 0
+}
+
+// listParser accumulates proxies from a list one line at a time,
+// deduping as it goes, so memory grows with the proxies found rather
+// than the size of the list.
+type listParser struct {
+	format   string
+	scheme   []Proxy // socks5:// and http://[user:pass@]ip:port entries
+	hostport []Proxy // bare host:port lines
+	seen     map[string]bool
+	seenHP   map[string]bool
+
+	// Matches dropped by validHostPort or validAuth, per format
+	badScheme, badHP int
 }
 
-func Scrape(url string) ([]Proxy, error) {
-	resp, err := http.Get(url)
-	if err != nil {
-		return nil, fmt.Errorf("fetch failed: %w", err)
+func newListParser(format string) *listParser {
+	return &listParser{
+		format: format,
+		seen:   make(map[string]bool),
+		seenHP: make(map[string]bool),
 	}
-	defer resp.Body.Close()
+}
 
-	if resp.StatusCode != http.StatusOK {
-		return nil, fmt.Errorf("unexpected status: %d", resp.StatusCode)
+func (lp *listParser) parseLine(line string) {
+	if lp.format != FormatHostPort {
+		lp.parseScheme(line)
 	}
+	// In auto mode hostport is only used if nothing had a scheme, but
+	// we can't know that until the end, so collect both.
+	if lp.format != FormatScheme {
+		lp.parseHostPort(line)
+	}
+}
 
-	body, err := io.ReadAll(resp.Body)
-	if err != nil {
-		return nil, fmt.Errorf("read body failed: %w", err)
+// result picks the entries for the configured format, along with how
+// many matches of that format were invalid.
+func (lp *listParser) result() ([]Proxy, int) {
+	switch lp.format {
+	case FormatScheme:
+		return lp.scheme, lp.badScheme
+	case FormatHostPort:
+		return lp.hostport, lp.badHP
+	}
+	if len(lp.scheme) > 0 {
+		return lp.scheme, lp.badScheme
 	}
+	return lp.hostport, lp.badHP
+}
 
-	matches := proxyRegex.FindAllStringSubmatch(string(body), -1)
-	seen := make(map[string]bool)
-	var proxies []Proxy
+// validHostPort rejects what the regexes let through but can't be
+// dialled: octets over 255 and ports outside 1-65535. A host that
+// isn't all digits and dots is taken as a hostname.
+func validHostPort(host, port string) bool {
+	n, err := strconv.Atoi(port)
+	if err != nil || n < 1 || n > 65535 {
+		return false
+	}
+	if strings.Trim(host, "0123456789.") == "" {
+		return net.ParseIP(host) != nil
+	}
+	return true
+}
 
-	for _, m := range matches {
-		addr := m[1] + ":" + m[2]
-		if seen[addr] {
+// parseScheme extracts socks5://, tls-socks5:// and
+// http://[user:pass@]ip:port entries.
+func (lp *listParser) parseScheme(line string) {
+	for _, m := range proxyRegex.FindAllStringSubmatch(line, -1) {
+		ip, ok := unbracket(m[4])
+		if !ok || !validHostPort(ip, m[5]) || !validAuth(m[2], m[3]) {
+			lp.badScheme++
+			continue
+		}
+		scheme, useTLS, _ := proxyScheme(m[1])
+		px := Proxy{Scheme: scheme, TLS: useTLS, IP: ip, Port: m[5], User: m[2], Pass: m[3]}
+		if lp.seen[px.Addr()] {
 			continue
 		}
-		seen[addr] = true
-		proxies = append(proxies, Proxy{
-			IP:   strings.TrimSpace(m[1]),
-			Port: strings.TrimSpace(m[2]),
-		})
+		lp.seen[px.Addr()] = true
+		lp.scheme = append(lp.scheme, px)
 	}
+}
 
-	log.Printf("[scraper] fetched %d proxies from %s", len(proxies), url)
-	return proxies, nil
+// parseHostPort takes one host:port per line, as in plain-text lists.
+// The first CSV column may also hold host,port. Blank lines and lines
+// starting with # are ignored.
+func (lp *listParser) parseHostPort(line string) {
+	line = strings.TrimSpace(line)
+	if line == "" || strings.HasPrefix(line, "#") {
+		return
+	}
+	m := hostPortRegex.FindStringSubmatch(line)
+	if m == nil {
+		return
+	}
+	host, ok := unbracket(m[1])
+	if !ok || !validHostPort(host, m[2]) {
+		lp.badHP++
+		return
+	}
+	px := Proxy{Scheme: SchemeSOCKS5, IP: host, Port: m[2]}
+	if lp.seenHP[px.Addr()] {
+		return
+	}
+	lp.seenHP[px.Addr()] = true
+	lp.hostport = append(lp.hostport, px)
 }
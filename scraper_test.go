@@ -0,0 +1,69 @@
+package main
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestParseListValidation(t *testing.T) {
+	tests := []struct {
+		name   string
+		format string
+		list   string
+		want   []string // addrs, in order
+		bad    int      // invalid matches of the format
+	}{
+		{"scheme ok", FormatScheme, "socks5://1.2.3.4:1080", []string{"1.2.3.4:1080"}, 0},
+		{"scheme octet over 255", FormatScheme, "socks5://1.2.3.256:1080", nil, 1},
+		{"scheme port 0", FormatScheme, "socks5://1.2.3.4:0", nil, 1},
+		{"scheme port 65536", FormatScheme, "http://1.2.3.4:65536", nil, 1},
+		{"scheme ipv6", FormatScheme, "socks5://[2001:db8::1]:1080", []string{"[2001:db8::1]:1080"}, 0},
+		{"scheme bad ipv6", FormatScheme, "socks5://[zz::1]:1080", nil, 1},
+		{"scheme ipv6 two ::", FormatScheme, "socks5://[fff::1::2]:1080", nil, 1},
+		{"scheme bracketed ipv4", FormatScheme, "socks5://[1.2.3.4]:1080", nil, 1},
+		{"scheme auth ok", FormatScheme, "socks5://u:p@1.2.3.4:1080", []string{"1.2.3.4:1080"}, 0},
+		{"scheme user over 255", FormatScheme, "socks5://" + strings.Repeat("u", 256) + ":p@1.2.3.4:1080", nil, 1},
+		{"scheme pass over 255", FormatScheme, "socks5://u:" + strings.Repeat("p", 256) + "@1.2.3.4:1080", nil, 1},
+		{"scheme mixed line", FormatScheme,
+			"socks5://1.2.3.4:1080 socks5://1.2.3.400:1080 http://[::1]:3128 socks5://5.6.7.8:99999",
+			[]string{"1.2.3.4:1080", "[::1]:3128"}, 2},
+
+		{"hostport ok", FormatHostPort, "1.2.3.4:1080\n1.2.3.5,8080", []string{"1.2.3.4:1080", "1.2.3.5:8080"}, 0},
+		{"hostport octet over 255", FormatHostPort, "1.2.3.999:1080", nil, 1},
+		{"hostport port 0", FormatHostPort, "1.2.3.4:0", nil, 1},
+		{"hostport port 65536", FormatHostPort, "1.2.3.4:65536", nil, 1},
+		{"hostport ipv6", FormatHostPort, "[::1]:1080", []string{"[::1]:1080"}, 0},
+		{"hostport bad ipv6", FormatHostPort, "[zz::1]:1080", nil, 1},
+		{"hostport hostname", FormatHostPort, "proxy.example.com:3128", []string{"proxy.example.com:3128"}, 0},
+		{"hostport comments", FormatHostPort, "# 1.2.3.4:0\n\n1.2.3.4:1080\n1.2.3.4:1080",
+			[]string{"1.2.3.4:1080"}, 0},
+		{"hostport several bad", FormatHostPort, "256.1.1.1:80\n1.1.1.1:0\n1.1.1.1:80", []string{"1.1.1.1:80"}, 2},
+
+		{"auto falls back to hostport", FormatAuto, "1.2.3.4:1080\n1.2.3.4:0", []string{"1.2.3.4:1080"}, 1},
+		{"auto prefers scheme", FormatAuto, "socks5://1.2.3.4:1080\n5.6.7.8:80", []string{"1.2.3.4:1080"}, 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			proxies, err := parseList(strings.NewReader(tt.list), tt.format)
+			if err != nil {
+				t.Fatalf("parseList: %v", err)
+			}
+			var got []string
+			for _, px := range proxies {
+				got = append(got, px.Addr())
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("parseList = %v, want %v", got, tt.want)
+			}
+
+			lp := newListParser(tt.format)
+			for _, line := range strings.Split(tt.list, "\n") {
+				lp.parseLine(line)
+			}
+			if _, bad := lp.result(); bad != tt.bad {
+				t.Errorf("invalid count = %d, want %d (badScheme %d, badHP %d)", bad, tt.bad, lp.badScheme, lp.badHP)
+			}
+		})
+	}
+}
@@ -0,0 +1,39 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"strconv"
+	"time"
+)
+
+// selfTest connects to our own listener as a SOCKS5 client and fetches
+// the check URL, so the whole handshake -> pool -> relay path is proven
+// before the first real client relies on it. A Unix socket listener
+// isn't reachable through dialVia and is skipped.
+func selfTest(ctx context.Context, cfg *Config, server *Server) error {
+	addr, ok := server.Addr().(*net.TCPAddr)
+	if !ok {
+		infof("[main] self-test skipped, %s is not a TCP listener", cfg.ListenAddr)
+		return nil
+	}
+	ip := addr.IP
+	if ip == nil || ip.IsUnspecified() {
+		ip = net.IPv4(127, 0, 0, 1)
+	}
+	self := Proxy{Scheme: SchemeSOCKS5, IP: ip.String(), Port: strconv.Itoa(addr.Port)}
+	for user, pass := range cfg.Credentials {
+		self.User, self.Pass = user, pass
+		break
+	}
+
+	// The server may try several upstreams before the check request
+	timeout := time.Duration(cfg.ConnectRetries)*cfg.DialTimeout + cfg.CheckTimeout
+	latency, err := checkConnectivity(ctx, self, cfg.CheckTarget, cfg.CheckPath, timeout)
+	if err != nil {
+		return fmt.Errorf("could not fetch http://%s%s through %s: %w", cfg.CheckTarget, cfg.CheckPath, self.Addr(), err)
+	}
+	infof("[main] self-test passed: fetched http://%s%s through our own listener in %s", cfg.CheckTarget, cfg.CheckPath, latency.Round(time.Millisecond))
+	return nil
+}
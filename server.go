@@ -1,106 +1,724 @@
 package main
 
 import (
+	"context"
+	"crypto/subtle"
+	"errors"
 	"fmt"
 	"io"
-	"log"
 	"net"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
 	"time"
 )
 
 const (
 	socks5Version = 0x05
 	cmdConnect    = 0x01
+	cmdBind       = 0x02
+	cmdUDP        = 0x03
 	atypIPv4      = 0x01
 	atypDomain    = 0x03
 	atypIPv6      = 0x04
+
+	authNone         = 0x00
+	authUserPass     = 0x02
+	authNoAcceptable = 0xFF
+	authVersion      = 0x01 // RFC 1929 sub-negotiation version
+)
+
+var (
+	errAddrType  = errors.New("unsupported address type")
+	errNoProxies = errors.New("no proxies available")
+)
+
+// SOCKS5 reply codes (RFC 1928 section 6) sent on a failed request.
+const (
+	replyGeneralFailure  = 0x01
+	replyNotAllowed      = 0x02
+	replyNetUnreachable  = 0x03
+	replyHostUnreachable = 0x04
+	replyRefused         = 0x05
+	replyTTLExpired      = 0x06
+	replyCmdUnsupported  = 0x07
+	replyAddrUnsupported = 0x08
 )
 
+// replyError is a failure reply from an upstream SOCKS5 proxy. Its code
+// is the exit's verdict on the target, so it is passed on to the client.
+type replyError struct {
+	cmd  string
+	code byte
+}
+
+func (e *replyError) Error() string {
+	return fmt.Sprintf("upstream %s failed, status: %d", e.cmd, e.code)
+}
+
+// replyCode picks the reply for a failed request: the upstream's own
+// code when it gave one, otherwise one matching a direct dial or local
+// resolve error, otherwise general failure. Errors reaching an upstream
+// proxy itself aren't wrapped into the error dialPool returns, so a
+// proxy refusing us is never reported as the target refusing.
+func replyCode(err error) byte {
+	var re *replyError
+	if errors.As(err, &re) {
+		if re.code > replyGeneralFailure && re.code <= replyAddrUnsupported {
+			return re.code
+		}
+		return replyGeneralFailure
+	}
+	var dnsErr *net.DNSError
+	var netErr net.Error
+	switch {
+	case errors.Is(err, syscall.ECONNREFUSED):
+		return replyRefused
+	case errors.Is(err, syscall.ENETUNREACH):
+		return replyNetUnreachable
+	case errors.Is(err, syscall.EHOSTUNREACH), errors.Is(err, syscall.EHOSTDOWN), errors.As(err, &dnsErr):
+		return replyHostUnreachable
+	case errors.As(err, &netErr) && netErr.Timeout():
+		// No code means "timed out"; clients read TTL expired that way
+		return replyTTLExpired
+	}
+	return replyGeneralFailure
+}
+
 type Server struct {
-	listenAddr string
-	pool       *ProxyPool
+	listenAddr  string
+	pool        *ProxyPool
+	dialTimeout time.Duration
+	idleTimeout time.Duration
+	allowDirect bool // dial targets directly when no upstream works
+	chainLength int  // pool proxies per connection; the last is the exit
+	retries     int  // upstreams tried per connection
+	resolve     string
+	defaultTag  string
+	clientTags  []ClientTag
+	relayBufs   *bufferPool
+	limiter     *ClientLimiter // -client-rate; nil = unlimited
+
+	mu       sync.Mutex
+	ln       net.Listener
+	ready    chan struct{} // closed once ln is bound
+	closed   bool
+	draining bool           // stopped accepting by Drain; relays carry on
+	conns    sync.WaitGroup // active client connections
+
+	sem      chan struct{} // caps concurrent handlers; nil = unlimited
+	maxConns int
+	active   atomic.Int64
+	verified atomic.Bool // the startup self-test relayed through us
+
+	// Totals since start, for the dashboard
+	served    atomic.Int64 // relayed connections
+	bytesUp   atomic.Int64 // client -> target
+	bytesDown atomic.Int64 // target -> client
+
+	// AccessLog records one line per request when non-nil.
+	AccessLog *AccessLog
+
+	// Credentials maps username -> password for RFC 1929 auth.
+	// When empty, clients connect without authentication.
+	Credentials map[string]string
+}
+
+// connQueueWait is how long a new connection may wait for a free slot
+// when -max-conns is reached before it is dropped.
+const connQueueWait = time.Second
+
+func NewServer(cfg *Config, pool *ProxyPool) *Server {
+	s := &Server{
+		listenAddr:  cfg.ListenAddr,
+		pool:        pool,
+		dialTimeout: cfg.DialTimeout,
+		idleTimeout: cfg.RelayIdleTimeout,
+		allowDirect: cfg.AllowDirect,
+		chainLength: cfg.ChainLength,
+		retries:     cfg.ConnectRetries,
+		resolve:     cfg.Resolve,
+		defaultTag:  cfg.DefaultTag,
+		clientTags:  cfg.ClientTags,
+		relayBufs:   newBufferPool(cfg.RelayBuffer),
+		maxConns:    cfg.MaxConns,
+		Credentials: cfg.Credentials,
+		ready:       make(chan struct{}),
+	}
+	if cfg.MaxConns > 0 {
+		s.sem = make(chan struct{}, cfg.MaxConns)
+	}
+	if cfg.ClientRate > 0 {
+		s.limiter = NewClientLimiter(cfg.ClientRate, cfg.ClientRatePer)
+	}
+	return s
+}
+
+// ActiveConns returns the number of connections being handled.
+func (s *Server) ActiveConns() int64 {
+	return s.active.Load()
 }
 
-func NewServer(listenAddr string, pool *ProxyPool) *Server {
-	return &Server{
-		listenAddr: listenAddr,
-		pool:       pool,
+// Traffic returns the number of relayed connections and the bytes
+// moved each way since start.
+func (s *Server) Traffic() (served, up, down int64) {
+	return s.served.Load(), s.bytesUp.Load(), s.bytesDown.Load()
+}
+
+// addTraffic records one finished relay.
+func (s *Server) addTraffic(up, down int64) {
+	s.served.Add(1)
+	s.bytesUp.Add(up)
+	s.bytesDown.Add(down)
+}
+
+// MaxConns returns the concurrent connection cap, 0 if unlimited.
+func (s *Server) MaxConns() int {
+	return s.maxConns
+}
+
+// acquire waits briefly for a connection slot. It returns false if the
+// server stayed full, in which case the caller drops the connection.
+func (s *Server) acquire() bool {
+	if s.sem == nil {
+		return true
+	}
+	select {
+	case s.sem <- struct{}{}:
+		return true
+	default:
+	}
+	t := time.NewTimer(connQueueWait)
+	defer t.Stop()
+	select {
+	case s.sem <- struct{}{}:
+		return true
+	case <-t.C:
+		return false
 	}
 }
 
+func (s *Server) release() {
+	if s.sem != nil {
+		<-s.sem
+	}
+}
+
+// Start listens and serves until Shutdown or Drain closes the listener.
 func (s *Server) Start() error {
-	ln, err := net.Listen("tcp", s.listenAddr)
+	network, addr := listenNetwork(s.listenAddr)
+	if network == "unix" {
+		removeStaleSocket(addr)
+	}
+	ln, err := net.Listen(network, addr)
 	if err != nil {
 		return fmt.Errorf("listen failed: %w", err)
 	}
-	log.Printf("[server] SOCKS5 proxy listening on %s", s.listenAddr)
+	s.mu.Lock()
+	if s.closed {
+		s.mu.Unlock()
+		ln.Close()
+		return nil
+	}
+	s.ln = ln
+	close(s.ready)
+	s.mu.Unlock()
+	infof("[server] SOCKS5 proxy listening on %s", s.listenAddr)
 
 	for {
 		conn, err := ln.Accept()
 		if err != nil {
-			log.Printf("[server] accept error: %v", err)
+			if errors.Is(err, net.ErrClosed) {
+				return nil
+			}
+			errorf("[server] accept error: %v", err)
 			continue
 		}
-		go s.handleConn(conn)
+		if !s.acquire() {
+			warnf("[server] connection limit %d reached, rejecting %s", s.maxConns, conn.RemoteAddr())
+			conn.Close()
+			continue
+		}
+		s.conns.Add(1)
+		s.active.Add(1)
+		go func() {
+			defer s.conns.Done()
+			defer s.active.Add(-1)
+			defer s.release()
+			s.handleConn(conn)
+		}()
+	}
+}
+
+// Ready is closed once Start has bound the listener.
+func (s *Server) Ready() <-chan struct{} {
+	return s.ready
+}
+
+// Addr returns the bound listener address, nil before Ready.
+func (s *Server) Addr() net.Addr {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.ln == nil {
+		return nil
+	}
+	return s.ln.Addr()
+}
+
+// listenNetwork maps a -listen value to net.Listen arguments:
+// unix:///path/to.sock is a Unix socket, anything else is TCP host:port.
+func listenNetwork(listenAddr string) (network, addr string) {
+	if path, ok := strings.CutPrefix(listenAddr, "unix://"); ok {
+		return "unix", path
+	}
+	return "tcp", listenAddr
+}
+
+// removeStaleSocket deletes a socket file left by an earlier run that
+// didn't shut down cleanly. Anything that isn't a socket is left alone
+// so Listen fails loudly instead.
+func removeStaleSocket(path string) {
+	if fi, err := os.Lstat(path); err == nil && fi.Mode()&os.ModeSocket != 0 {
+		os.Remove(path)
+	}
+}
+
+// Drain stops accepting new connections while active ones carry on
+// until they close, for rolling deploys. It can't be undone; Shutdown
+// still waits for whatever is left.
+func (s *Server) Drain() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.draining {
+		return
+	}
+	s.draining, s.closed = true, true
+	if s.ln != nil {
+		s.ln.Close()
+	}
+	infof("[server] draining: no longer accepting, %d connections still active", s.active.Load())
+}
+
+// MarkVerified records that the startup self-test passed.
+func (s *Server) MarkVerified() {
+	s.verified.Store(true)
+}
+
+// Verified reports whether the startup self-test has passed.
+func (s *Server) Verified() bool {
+	return s.verified.Load()
+}
+
+// Draining reports whether Drain has been called.
+func (s *Server) Draining() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.draining
+}
+
+// Shutdown closes the listener and waits for active connections to
+// finish, or for ctx to expire. Closing a Unix listener also removes
+// its socket file.
+func (s *Server) Shutdown(ctx context.Context) error {
+	s.mu.Lock()
+	s.closed = true
+	if s.ln != nil {
+		s.ln.Close()
+	}
+	s.mu.Unlock()
+
+	drained := make(chan struct{})
+	go func() {
+		s.conns.Wait()
+		close(drained)
+	}()
+	select {
+	case <-drained:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
 	}
 }
 
 func (s *Server) handleConn(conn net.Conn) {
 	defer conn.Close()
 
-	// 1. SOCKS5 handshake - read greeting
-	buf := make([]byte, 256)
-	n, err := conn.Read(buf)
-	if err != nil || n < 2 || buf[0] != socks5Version {
+	// Peek the version byte: SOCKS4/4a gets its own handler
+	hdr := make([]byte, 2)
+	if _, err := io.ReadFull(conn, hdr[:1]); err != nil {
+		return
+	}
+	switch hdr[0] {
+	case socks4Version:
+		s.handleSOCKS4(conn)
+		return
+	case socks5Version:
+	default:
 		return
 	}
 
-	// Reply: no auth required
-	conn.Write([]byte{socks5Version, 0x00})
+	// 1. SOCKS5 handshake - read greeting (ver, nmethods, methods...)
+	if _, err := io.ReadFull(conn, hdr[1:]); err != nil {
+		return
+	}
+	methods := make([]byte, hdr[1])
+	if _, err := io.ReadFull(conn, methods); err != nil {
+		return
+	}
+
+	// Negotiate auth method
+	method := s.selectMethod(methods)
+	conn.Write([]byte{socks5Version, method})
+	switch method {
+	case authNoAcceptable:
+		return
+	case authUserPass:
+		if !s.authenticate(conn) {
+			return
+		}
+	}
 
 	// 2. Read connect request
-	n, err = conn.Read(buf)
-	if err != nil || n < 7 || buf[1] != cmdConnect {
-		s.sendReply(conn, 0x07) // command not supported
+	buf, err := readSOCKS5Msg(conn)
+	if err != nil {
+		if errors.Is(err, errAddrType) {
+			s.sendReply(conn, replyAddrUnsupported)
+		}
+		return
+	}
+	if !s.allowClient(conn) {
+		s.sendReply(conn, replyNotAllowed)
+		return
+	}
+	if buf[1] != cmdConnect && buf[1] != cmdBind && buf[1] != cmdUDP {
+		s.sendReply(conn, replyCmdUnsupported)
 		return
 	}
 
 	// Parse target address
-	targetAddr, err := parseTarget(buf[:n])
+	targetAddr, err := parseTarget(buf)
 	if err != nil {
-		s.sendReply(conn, 0x04) // host unreachable
+		s.sendReply(conn, replyHostUnreachable)
+		return
+	}
+
+	if buf[1] == cmdBind {
+		s.handleBind(conn, targetAddr)
+		return
+	}
+
+	if buf[1] == cmdUDP {
+		// UDP replies go to the client's IP, which a Unix socket lacks
+		if _, ok := conn.LocalAddr().(*net.TCPAddr); !ok {
+			s.sendReply(conn, replyCmdUnsupported)
+			return
+		}
+		// DST.ADDR is the client's expected source, not a target
+		s.handleUDPAssociate(conn)
 		return
 	}
 
 	// 3. Use current proxy, switch on failure
-	maxRetries := 3
-	for i := 0; i < maxRetries; i++ {
-		var upstream Proxy
-		var ok bool
-		if i == 0 {
-			upstream, ok = s.pool.Current()
+	entry := AccessEntry{Client: conn.RemoteAddr().String(), Target: targetAddr, Start: time.Now()}
+	remote, upstream, err := s.dialUpstream(clientIP(conn), targetAddr)
+	entry.Upstream = upstreamLabel(upstream)
+	if err != nil {
+		s.sendReply(conn, replyCode(err))
+		entry.Err = err
+		s.AccessLog.Log(entry)
+		return
+	}
+	defer s.pool.Release(upstream.Addr())
+	s.sendBoundReply(conn, remote)
+	entry.BytesUp, entry.BytesDown = relay(conn, remote, s.idleTimeout, s.relayBufs)
+	s.addTraffic(entry.BytesUp, entry.BytesDown)
+	s.AccessLog.Log(entry)
+}
+
+// dialUpstream connects to target through the pool, switching to
+// another proxy on failure (up to -connect-retries attempts). It returns the last
+// upstream tried, even on failure, for logging. With -allow-direct it
+// falls back to dialing target itself, returning directUpstream, also
+// when -resolve local can't resolve target.
+// On success the caller must Release the upstream's relay slot.
+func (s *Server) dialUpstream(client, target string) (net.Conn, Proxy, error) {
+	var (
+		remote   net.Conn
+		upstream Proxy
+		err      error
+	)
+	if s.resolve == ResolveLocal {
+		var resolved string
+		if resolved, err = s.resolveTarget(target); err != nil {
+			warnf("[server] resolving %s for %s: %v", target, client, err)
 		} else {
-			upstream, ok = s.pool.SwitchNext()
+			target = resolved
+		}
+	}
+	if err == nil {
+		remote, upstream, err = s.dialPool(client, target)
+	}
+	if err == nil || !s.allowDirect {
+		return remote, upstream, err
+	}
+	warnf("[server] no working upstream, connecting DIRECTLY to %s for %s (not proxied)", target, client)
+	remote, err = net.DialTimeout("tcp", target, s.dialTimeout)
+	return remote, directUpstream, err
+}
+
+// Where domain targets are resolved, from -resolve.
+const (
+	ResolveRemote = "remote" // by the exit proxy, so no DNS leaks from here
+	ResolveLocal  = "local"  // by us, sending the upstream an IP
+)
+
+// resolveTarget replaces a domain in target with its first address, so
+// the upstream gets an IP and its own DNS is never used. IP targets
+// pass through unchanged.
+func (s *Server) resolveTarget(target string) (string, error) {
+	host, port, err := net.SplitHostPort(target)
+	if err != nil || net.ParseIP(host) != nil {
+		return target, err
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), s.dialTimeout)
+	defer cancel()
+	addrs, err := net.DefaultResolver.LookupIPAddr(ctx, host)
+	if err != nil {
+		return "", err
+	}
+	if len(addrs) == 0 {
+		return "", fmt.Errorf("no addresses for %s", host)
+	}
+	debugf("[server] resolved %s to %s", host, addrs[0].IP)
+	return net.JoinHostPort(addrs[0].IP.String(), port), nil
+}
+
+// directUpstream stands in for the upstream of a direct connection.
+var directUpstream = Proxy{Scheme: "direct"}
+
+// dialPool tries up to -connect-retries different upstreams from the
+// pool, stopping early once every proxy in it has failed.
+func (s *Server) dialPool(client, target string) (net.Conn, Proxy, error) {
+	evicted := false
+	tried := make(map[string]bool)
+	var (
+		upstream Proxy
+		verdict  *replyError // the last exit's reply about target
+	)
+	for i := 0; i < s.retries; i++ {
+		px, ok := s.pickUntried(client, i, evicted, tried)
+		if !ok && i == 0 {
+			warnf("[server] no proxies available")
+			return nil, upstream, errNoProxies
 		}
 		if !ok {
-			log.Printf("[server] no proxies available")
-			s.sendReply(conn, 0x01) // general failure
-			return
+			return nil, upstream, poolFailed(fmt.Sprintf("all %d upstreams in the pool failed", i), verdict)
 		}
+		upstream = px
+		tried[upstream.Addr()] = true
 
-		remote, err := dialViaSOCKS5(upstream, targetAddr, 10*time.Second)
+		hops, err := s.chainHops(upstream)
 		if err != nil {
-			log.Printf("[server] upstream %s failed: %v, switching...", upstream.Addr(), err)
+			warnf("[server] %v", err)
+			s.pool.Release(upstream.Addr())
+			return nil, upstream, err
+		}
+		remote, err := dialChain(context.Background(), hops, target, s.dialTimeout)
+		if err != nil {
+			warnf("[server] upstream %s failed: %v, switching...", upstream.Addr(), err)
+			s.pool.Release(upstream.Addr())
+			// Blame the hop that actually failed, which may not be the exit
+			failed := upstream
+			var he *hopError
+			if errors.As(err, &he) {
+				failed = he.hop
+			}
+			var re *replyError
+			if errors.As(err, &re) && failed.Addr() == upstream.Addr() {
+				verdict = re
+			}
+			evicted = s.pool.MarkFailure(failed.Addr(), err) && failed.Addr() == upstream.Addr()
 			continue
 		}
+		for _, hop := range hops {
+			s.pool.MarkSuccess(hop.Addr())
+		}
+		return remote, upstream, nil
+	}
+	return nil, upstream, poolFailed(fmt.Sprintf("all %d upstream attempts failed", s.retries), verdict)
+}
 
-		// Success
-		s.sendReply(conn, 0x00)
-		relay(conn, remote)
-		return
+// poolFailed is dialPool's error after retries, wrapping the last
+// exit's verdict on the target, if any, for replyCode.
+func poolFailed(msg string, verdict *replyError) error {
+	if verdict == nil {
+		return errors.New(msg)
+	}
+	return fmt.Errorf("%s: %w", msg, verdict)
+}
+
+// pickUntried is pickUpstream for a retry loop: a proxy already tried
+// for this connection is released and the pick moves on, rather than
+// wrapping around to it in a small pool. It fails once the pool is
+// empty or holds nothing untried.
+func (s *Server) pickUntried(client string, attempt int, evicted bool, tried map[string]bool) (Proxy, bool) {
+	for n := s.pool.Size(); n > 0; n-- {
+		px, ok := s.pickUpstream(client, attempt, evicted, tried)
+		if !ok || !tried[px.Addr()] {
+			return px, ok
+		}
+		s.pool.Release(px.Addr())
+		// Any further pick must move on from the current proxy
+		attempt, evicted = max(attempt, 1), false
+	}
+	return Proxy{}, false
+}
+
+// chainHops returns the proxies to pass through to reach upstream:
+// -chain-length - 1 random other pool members, then upstream itself as
+// the exit. A pool too small for the chain is an error rather than a
+// silently shorter chain.
+func (s *Server) chainHops(upstream Proxy) ([]Proxy, error) {
+	if s.chainLength <= 1 {
+		return []Proxy{upstream}, nil
+	}
+	hops := s.pool.Sample(s.chainLength-1, upstream.Addr())
+	if len(hops) < s.chainLength-1 {
+		return nil, fmt.Errorf("chain of %d needs %d proxies, pool has %d", s.chainLength, s.chainLength, len(hops)+1)
+	}
+	return append(hops, upstream), nil
+}
+
+// authenticate runs the RFC 1929 username/password sub-negotiation.
+func (s *Server) authenticate(conn net.Conn) bool {
+	// ver, ulen
+	hdr := make([]byte, 2)
+	if _, err := io.ReadFull(conn, hdr); err != nil || hdr[0] != authVersion {
+		return false
+	}
+	user := make([]byte, hdr[1])
+	if _, err := io.ReadFull(conn, user); err != nil {
+		return false
+	}
+	// plen
+	if _, err := io.ReadFull(conn, hdr[:1]); err != nil {
+		return false
+	}
+	pass := make([]byte, hdr[0])
+	if _, err := io.ReadFull(conn, pass); err != nil {
+		return false
+	}
+
+	want, ok := s.Credentials[string(user)]
+	if !ok || subtle.ConstantTimeCompare([]byte(want), pass) != 1 {
+		warnf("[server] auth failed for %q from %s", user, conn.RemoteAddr())
+		conn.Write([]byte{authVersion, 0x01})
+		return false
+	}
+	conn.Write([]byte{authVersion, 0x00})
+	return true
+}
+
+// allowClient applies -client-rate to conn's source IP. Unix socket
+// clients have none and are never limited.
+func (s *Server) allowClient(conn net.Conn) bool {
+	ip := clientIP(conn)
+	if ip == "" || s.limiter.Allow(ip) {
+		return true
 	}
+	warnf("[server] client %s over -client-rate, rejecting", ip)
+	return false
+}
+
+// clientIP returns the remote IP of conn, used as the session key.
+func clientIP(conn net.Conn) string {
+	host, _, err := net.SplitHostPort(conn.RemoteAddr().String())
+	if err != nil {
+		return ""
+	}
+	return host
+}
 
-	s.sendReply(conn, 0x01) // general failure after retries
+// selectMethod picks the auth method from the client's offer: the
+// only one we accept is username/password when -auth is set, and no
+// auth otherwise. A client that didn't offer it (say, GSSAPI only)
+// gets authNoAcceptable and is dropped, as RFC 1928 requires.
+func (s *Server) selectMethod(methods []byte) byte {
+	want := byte(authNone)
+	if len(s.Credentials) > 0 {
+		want = authUserPass
+	}
+	if !hasMethod(methods, want) {
+		return authNoAcceptable
+	}
+	return want
+}
+
+func hasMethod(methods []byte, m byte) bool {
+	for _, b := range methods {
+		if b == m {
+			return true
+		}
+	}
+	return false
+}
+
+// pickUpstream selects the proxy for the given connection attempt and
+// takes a relay slot on it, which the caller must Release.
+// A client with a live session pin reuses its proxy on the first
+// attempt; otherwise the pick is pinned to the client for next time.
+// A proxy at -max-per-proxy is swapped for the least-loaded one.
+// A client scoped to a tag only gets proxies carrying it, other than
+// those in tried.
+func (s *Server) pickUpstream(client string, attempt int, evicted bool, tried map[string]bool) (Proxy, bool) {
+	tag := s.tagFor(client)
+	if attempt == 0 {
+		if px, ok := s.pool.Affinity(client); ok && px.HasTag(tag) {
+			return s.acquireUpstream(px, tag)
+		}
+	}
+	var (
+		px Proxy
+		ok bool
+	)
+	if tag != "" {
+		px, ok = s.pool.Tagged(tag, tried)
+	} else {
+		px, ok = s.selectUpstream(attempt, evicted, tried)
+	}
+	if !ok {
+		return px, false
+	}
+	if px, ok = s.acquireUpstream(px, tag); ok {
+		s.pool.Pin(client, px.Addr())
+	}
+	return px, ok
+}
+
+func (s *Server) acquireUpstream(px Proxy, tag string) (Proxy, bool) {
+	px, ok := s.pool.Acquire(px, tag)
+	if !ok {
+		warnf("[server] no usable proxy: every circuit is open or at -max-per-proxy")
+	}
+	return px, ok
+}
+
+// selectUpstream applies the pool strategy. Sticky mode starts on the
+// current proxy and fails over on retry, damped by -switch-cooldown;
+// other strategies ask the pool for a fresh pick every attempt.
+func (s *Server) selectUpstream(attempt int, evicted bool, tried map[string]bool) (Proxy, bool) {
+	switch {
+	case s.pool.Strategy() != StrategySticky:
+		return s.pool.Next()
+	case attempt == 0 || evicted:
+		// Eviction already moved current to the next proxy
+		return s.pool.Current()
+	default:
+		return s.pool.Failover(tried)
+	}
 }
 
 func (s *Server) sendReply(conn net.Conn, status byte) {
@@ -108,6 +726,31 @@ func (s *Server) sendReply(conn net.Conn, status byte) {
 	conn.Write([]byte{socks5Version, status, 0x00, atypIPv4, 0, 0, 0, 0, 0, 0})
 }
 
+// sendBoundReply writes a success reply carrying remote's local
+// address as BND.ADDR/BND.PORT, the address our side of the relay is
+// bound to. Strict clients reject the 0.0.0.0:0 placeholder.
+func (s *Server) sendBoundReply(conn, remote net.Conn) {
+	if addr, ok := remote.LocalAddr().(*net.TCPAddr); ok && addr.IP != nil {
+		s.sendReplyAddr(conn, 0x00, addr.IP, addr.Port)
+		return
+	}
+	s.sendReply(conn, 0x00)
+}
+
+// sendReplyAddr writes a SOCKS5 reply with ip:port as BND.ADDR/BND.PORT.
+func (s *Server) sendReplyAddr(conn net.Conn, status byte, ip net.IP, port int) {
+	reply := []byte{socks5Version, status, 0x00}
+	if ip4 := ip.To4(); ip4 != nil {
+		reply = append(reply, atypIPv4)
+		reply = append(reply, ip4...)
+	} else {
+		reply = append(reply, atypIPv6)
+		reply = append(reply, ip.To16()...)
+	}
+	reply = append(reply, byte(port>>8), byte(port&0xff))
+	conn.Write(reply)
+}
+
 // parseTarget extracts the target address from a SOCKS5 connect request.
 func parseTarget(buf []byte) (string, error) {
 	if len(buf) < 7 {
@@ -125,7 +768,11 @@ func parseTarget(buf []byte) (string, error) {
 		host = fmt.Sprintf("%d.%d.%d.%d", buf[4], buf[5], buf[6], buf[7])
 		portOffset = 8
 	case atypDomain:
+		// The length byte caps domains at 255; zero is never valid.
 		domainLen := int(buf[4])
+		if domainLen == 0 {
+			return "", fmt.Errorf("empty domain")
+		}
 		if len(buf) < 5+domainLen+2 {
 			return "", fmt.Errorf("domain request too short")
 		}
@@ -143,42 +790,210 @@ func parseTarget(buf []byte) (string, error) {
 	}
 
 	port := int(buf[portOffset])<<8 | int(buf[portOffset+1])
-	return fmt.Sprintf("%s:%d", host, port), nil
+	return net.JoinHostPort(host, strconv.Itoa(port)), nil
 }
 
-// dialViaSOCKS5 connects to target through an upstream SOCKS5 proxy.
-func dialViaSOCKS5(upstream Proxy, target string, timeout time.Duration) (net.Conn, error) {
-	conn, err := net.DialTimeout("tcp", upstream.Addr(), timeout)
-	if err != nil {
+// readSOCKS5Msg reads one framed request/reply (ver, cmd/rep, rsv, atyp,
+// addr, port) and returns it whole, ready for parseTarget.
+func readSOCKS5Msg(r io.Reader) ([]byte, error) {
+	buf := make([]byte, 4, 4+1+255+2)
+	if _, err := io.ReadFull(r, buf); err != nil {
 		return nil, err
 	}
-	conn.SetDeadline(time.Now().Add(timeout))
+	if buf[0] != socks5Version {
+		return nil, fmt.Errorf("not socks5")
+	}
+
+	var addrLen int
+	switch buf[3] {
+	case atypIPv4:
+		addrLen = 4
+	case atypIPv6:
+		addrLen = 16
+	case atypDomain:
+		l := make([]byte, 1)
+		if _, err := io.ReadFull(r, l); err != nil {
+			return nil, err
+		}
+		buf = append(buf, l[0])
+		addrLen = int(l[0])
+	default:
+		return nil, fmt.Errorf("%w: %d", errAddrType, buf[3])
+	}
+
+	rest := make([]byte, addrLen+2)
+	if _, err := io.ReadFull(r, rest); err != nil {
+		return nil, err
+	}
+	return append(buf, rest...), nil
+}
+
+// maxAuthLen is RFC 1929's limit on a username or password, whose
+// lengths are sent as one byte.
+const maxAuthLen = 255
+
+// validAuth reports whether user and pass fit an RFC 1929 request.
+func validAuth(user, pass string) bool {
+	return len(user) <= maxAuthLen && len(pass) <= maxAuthLen
+}
 
-	// SOCKS5 greeting
-	conn.Write([]byte{0x05, 0x01, 0x00})
+// socks5Handshake performs the client greeting on an upstream connection,
+// running the RFC 1929 sub-negotiation when the proxy has credentials.
+func socks5Handshake(conn net.Conn, upstream Proxy) error {
+	if !validAuth(upstream.User, upstream.Pass) {
+		return fmt.Errorf("upstream user or password over %d bytes", maxAuthLen)
+	}
+	if upstream.User != "" {
+		conn.Write([]byte{socks5Version, 0x02, authNone, authUserPass})
+	} else {
+		conn.Write([]byte{socks5Version, 0x01, authNone})
+	}
 	buf := make([]byte, 2)
 	if _, err := io.ReadFull(conn, buf); err != nil {
-		conn.Close()
+		return err
+	}
+	if buf[0] != socks5Version {
+		return fmt.Errorf("not socks5")
+	}
+
+	switch buf[1] {
+	case authNone:
+		return nil
+	case authUserPass:
+		if upstream.User == "" {
+			return fmt.Errorf("upstream requires auth")
+		}
+		req := []byte{authVersion, byte(len(upstream.User))}
+		req = append(req, upstream.User...)
+		req = append(req, byte(len(upstream.Pass)))
+		req = append(req, upstream.Pass...)
+		conn.Write(req)
+		if _, err := io.ReadFull(conn, buf); err != nil {
+			return err
+		}
+		if buf[1] != 0x00 {
+			return fmt.Errorf("upstream auth rejected")
+		}
+		return nil
+	default:
+		return fmt.Errorf("no acceptable auth method")
+	}
+}
+
+// dialVia connects to target through upstream using its protocol.
+// Cancelling ctx aborts the dial and any handshake still in flight.
+func dialVia(ctx context.Context, upstream Proxy, target string, timeout time.Duration) (net.Conn, error) {
+	return dialChain(ctx, []Proxy{upstream}, target, timeout)
+}
+
+// hopError records which proxy in a chain failed.
+type hopError struct {
+	hop Proxy
+	err error
+}
+
+func (e *hopError) Error() string { return "via " + e.hop.Addr() + ": " + e.err.Error() }
+func (e *hopError) Unwrap() error { return e.err }
+
+// dialChain connects to target through hops in series: it dials the
+// first, has each hop connect to the next inside the tunnel so far, and
+// the last one connect to target. Each handshake gets the full timeout.
+// A TLS hop is spoken to inside TLS, even deep in the tunnel.
+// Errors from a multi-hop chain are *hopError.
+func dialChain(ctx context.Context, hops []Proxy, target string, timeout time.Duration) (net.Conn, error) {
+	d := net.Dialer{Timeout: timeout}
+	raw, err := d.DialContext(ctx, "tcp", hops[0].Addr())
+	if err != nil {
+		if len(hops) > 1 {
+			err = &hopError{hops[0], err}
+		}
 		return nil, err
 	}
-	if buf[0] != 0x05 {
+
+	// A deadline in the past unblocks whatever read or write is pending
+	stop := context.AfterFunc(ctx, func() { raw.SetDeadline(time.Unix(1, 0)) })
+	conn := raw
+	for i, hop := range hops {
+		next := target
+		if i+1 < len(hops) {
+			next = hops[i+1].Addr()
+		}
+		if hop.TLS {
+			var tc net.Conn
+			if tc, err = startTLS(ctx, conn, hop, timeout); err == nil {
+				conn = tc
+			}
+		}
+		if err == nil {
+			err = connectVia(conn, hop, next, timeout)
+		}
+		if err != nil {
+			if len(hops) > 1 {
+				err = &hopError{hop, err}
+			}
+			break
+		}
+	}
+	if !stop() {
+		err = ctx.Err()
+	}
+	if err != nil {
 		conn.Close()
-		return nil, fmt.Errorf("not socks5")
+		return nil, err
+	}
+	return conn, nil
+}
+
+// connectVia asks the proxy at the far end of conn to connect to target
+// using its protocol.
+func connectVia(conn net.Conn, hop Proxy, target string, timeout time.Duration) error {
+	if hop.scheme() == SchemeHTTP {
+		return connectHTTP(conn, hop, target, timeout)
 	}
+	return connectSOCKS5(conn, hop, target, timeout)
+}
+
+// connectSOCKS5 asks the SOCKS5 proxy on conn to connect to target.
+// The caller owns conn and closes it on error.
+func connectSOCKS5(conn net.Conn, upstream Proxy, target string, timeout time.Duration) error {
+	conn.SetDeadline(time.Now().Add(timeout))
+
+	if err := socks5Handshake(conn, upstream); err != nil {
+		return err
+	}
+
+	req, err := socks5Request(cmdConnect, target)
+	if err != nil {
+		return err
+	}
+	conn.Write(req)
 
-	// Parse target host:port
+	// Read the whole reply, BND.ADDR included, so a reply split across
+	// packets neither fails nor leaves bytes to leak into the relay
+	reply, err := readSOCKS5Msg(conn)
+	if err != nil {
+		return fmt.Errorf("upstream connect reply: %w", err)
+	}
+	if reply[1] != 0x00 {
+		return &replyError{cmd: "connect", code: reply[1]}
+	}
+
+	// Clear deadline for relay
+	conn.SetDeadline(time.Time{})
+	return nil
+}
+
+// socks5Request builds a SOCKS5 request for cmd with target (host:port)
+// as DST.ADDR, as an IP where host is one and a domain otherwise.
+func socks5Request(cmd byte, target string) ([]byte, error) {
 	host, portStr, err := net.SplitHostPort(target)
 	if err != nil {
-		conn.Close()
 		return nil, err
 	}
 	port := 0
 	fmt.Sscanf(portStr, "%d", &port)
 
-	// Build connect request
-	req := []byte{0x05, 0x01, 0x00}
-
-	// Check if host is an IP
+	req := []byte{socks5Version, cmd, 0x00}
 	if ip := net.ParseIP(host); ip != nil {
 		if ip4 := ip.To4(); ip4 != nil {
 			req = append(req, atypIPv4)
@@ -188,38 +1003,33 @@ func dialViaSOCKS5(upstream Proxy, target string, timeout time.Duration) (net.Co
 			req = append(req, ip...)
 		}
 	} else {
-		// Domain name
 		req = append(req, atypDomain, byte(len(host)))
 		req = append(req, []byte(host)...)
 	}
-	req = append(req, byte(port>>8), byte(port&0xff))
-
-	conn.Write(req)
-
-	// Read reply
-	resp := make([]byte, 256)
-	n, err := conn.Read(resp)
-	if err != nil || n < 2 || resp[1] != 0x00 {
-		conn.Close()
-		if err != nil {
-			return nil, err
-		}
-		return nil, fmt.Errorf("upstream connect failed, status: %d", resp[1])
-	}
-
-	// Clear deadline for relay
-	conn.SetDeadline(time.Time{})
-	return conn, nil
+	return append(req, byte(port>>8), byte(port&0xff)), nil
 }
 
 // relay copies data bidirectionally between two connections.
-func relay(left, right net.Conn) {
+// Each direction half-closes its destination when done. The other
+// direction then has relayDrain of silence to finish (a download after
+// the client's FIN keeps going); a peer that never closes its side is
+// cut off by a read deadline instead of pinning the goroutine forever.
+// If idle > 0, the relay is torn down after no data has moved in
+// either direction for that long.
+//
+// Copy buffers come from bufs.
+//
+// It returns the bytes sent left->right (up) and right->left (down).
+func relay(left, right net.Conn, idle time.Duration, bufs *bufferPool) (up, down int64) {
 	defer left.Close()
 	defer right.Close()
 
+	st := &relayState{idle: idle, bufs: bufs}
+	st.lastActive.Store(time.Now().UnixNano())
+
 	done := make(chan struct{}, 2)
-	cp := func(dst, src net.Conn) {
-		io.Copy(dst, src)
+	cp := func(dst, src net.Conn, n *int64) {
+		*n, _ = copyIdle(dst, src, st)
 		// Try half-close if supported
 		if tc, ok := dst.(*net.TCPConn); ok {
 			tc.CloseWrite()
@@ -227,7 +1037,93 @@ func relay(left, right net.Conn) {
 		done <- struct{}{}
 	}
 
-	go cp(left, right)
-	go cp(right, left)
+	go cp(left, right, &down)
+	go cp(right, left, &up)
+
+	<-done
+	// Wake the other direction if it's blocked in a Read with no
+	// deadline; from here on it re-arms with the drain timeout
+	st.halfClosed.Store(true)
+	deadline := time.Now().Add(st.timeout())
+	left.SetReadDeadline(deadline)
+	right.SetReadDeadline(deadline)
 	<-done
+	return up, down
+}
+
+// minRelayBuffer is the smallest -relay-buffer accepted.
+const minRelayBuffer = 1024
+
+// bufferPool recycles relay copy buffers, so connection churn doesn't
+// allocate two fresh buffers per connection. It holds *[]byte so Put
+// doesn't allocate either.
+type bufferPool struct {
+	pool sync.Pool
+}
+
+func newBufferPool(size int) *bufferPool {
+	return &bufferPool{pool: sync.Pool{New: func() any {
+		b := make([]byte, size)
+		return &b
+	}}}
+}
+
+func (b *bufferPool) get() *[]byte  { return b.pool.Get().(*[]byte) }
+func (b *bufferPool) put(p *[]byte) { b.pool.Put(p) }
+
+// relayDrain is how long the remaining direction of a half-closed relay
+// may stay quiet before the relay is torn down.
+const relayDrain = 30 * time.Second
+
+// relayState is shared by both directions of a relay.
+type relayState struct {
+	idle       time.Duration
+	bufs       *bufferPool
+	lastActive atomic.Int64 // unix nanos of the last chunk either way
+	halfClosed atomic.Bool  // one direction has finished
+}
+
+// timeout is the read deadline to apply, 0 for none.
+func (st *relayState) timeout() time.Duration {
+	if st.halfClosed.Load() && (st.idle <= 0 || st.idle > relayDrain) {
+		return relayDrain
+	}
+	return st.idle
+}
+
+// copyIdle copies src to dst, resetting src's read deadline after each
+// chunk. A deadline hit only ends the copy when the other direction
+// has been quiet too, so one-way streams aren't cut off.
+func copyIdle(dst, src net.Conn, st *relayState) (int64, error) {
+	var written int64
+	bp := st.bufs.get()
+	defer st.bufs.put(bp)
+	buf := *bp
+	for {
+		if t := st.timeout(); t > 0 {
+			src.SetReadDeadline(time.Now().Add(t))
+		}
+		n, err := src.Read(buf)
+		if n > 0 {
+			st.lastActive.Store(time.Now().UnixNano())
+			wn, werr := dst.Write(buf[:n])
+			written += int64(wn)
+			if werr != nil {
+				return written, werr
+			}
+		}
+		if err != nil {
+			var ne net.Error
+			if errors.As(err, &ne) && ne.Timeout() {
+				// A wake-up from relay, or traffic the other way
+				if t := st.timeout(); t <= 0 || time.Since(time.Unix(0, st.lastActive.Load())) < t {
+					continue
+				}
+			}
+			if err == io.EOF {
+				return written, nil
+			}
+			return written, err
+		}
+	}
 }
@@ -0,0 +1,615 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"runtime"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// fakeUpstream is an in-process SOCKS5 proxy on 127.0.0.1:0. It serves
+// CONNECT by dialling the target for real, so tests exercise the client
+// side of the protocol against a peer that frames things its own way.
+type fakeUpstream struct {
+	user, pass string // require RFC 1929 auth when set
+	bnd        []byte // ATYP, BND.ADDR, BND.PORT of success replies; 0.0.0.0:0 if nil
+	split      bool   // write replies a byte at a time
+	reply      []byte // sent in place of the CONNECT reply, then the conn closes
+}
+
+// start serves f until the test ends and returns it as a pool proxy.
+func (f *fakeUpstream) start(t *testing.T) Proxy {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+	go func() {
+		for {
+			c, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go f.serve(c)
+		}
+	}()
+	addr := ln.Addr().(*net.TCPAddr)
+	return Proxy{Scheme: SchemeSOCKS5, IP: "127.0.0.1", Port: strconv.Itoa(addr.Port), User: f.user, Pass: f.pass}
+}
+
+func (f *fakeUpstream) serve(c net.Conn) {
+	defer c.Close()
+	c.SetDeadline(time.Now().Add(5 * time.Second))
+
+	hdr := make([]byte, 2)
+	if _, err := io.ReadFull(c, hdr); err != nil {
+		return
+	}
+	methods := make([]byte, hdr[1])
+	if _, err := io.ReadFull(c, methods); err != nil {
+		return
+	}
+	if f.user != "" {
+		if !hasMethod(methods, authUserPass) {
+			c.Write([]byte{socks5Version, authNoAcceptable})
+			return
+		}
+		c.Write([]byte{socks5Version, authUserPass})
+		user, pass, ok := readUserPass(c)
+		if !ok || user != f.user || pass != f.pass {
+			c.Write([]byte{authVersion, 0x01})
+			return
+		}
+		c.Write([]byte{authVersion, 0x00})
+	} else {
+		c.Write([]byte{socks5Version, authNone})
+	}
+
+	req, err := readSOCKS5Msg(c)
+	if err != nil {
+		return
+	}
+	target, err := parseTarget(req)
+	if err != nil {
+		return
+	}
+	if f.reply != nil {
+		f.write(c, f.reply)
+		return
+	}
+	remote, err := net.DialTimeout("tcp", target, time.Second)
+	if err != nil {
+		f.write(c, []byte{socks5Version, replyRefused, 0x00, atypIPv4, 0, 0, 0, 0, 0, 0})
+		return
+	}
+	defer remote.Close()
+	bnd := f.bnd
+	if bnd == nil {
+		bnd = []byte{atypIPv4, 0, 0, 0, 0, 0, 0}
+	}
+	f.write(c, append([]byte{socks5Version, 0x00, 0x00}, bnd...))
+
+	c.SetDeadline(time.Time{})
+	go io.Copy(remote, c)
+	io.Copy(c, remote)
+}
+
+func (f *fakeUpstream) write(c net.Conn, b []byte) {
+	if !f.split {
+		c.Write(b)
+		return
+	}
+	for i := range b {
+		c.Write(b[i : i+1])
+		time.Sleep(time.Millisecond)
+	}
+}
+
+// readUserPass reads an RFC 1929 request.
+func readUserPass(r io.Reader) (user, pass string, ok bool) {
+	b := make([]byte, 2)
+	if _, err := io.ReadFull(r, b); err != nil || b[0] != authVersion {
+		return "", "", false
+	}
+	u := make([]byte, b[1])
+	if _, err := io.ReadFull(r, u); err != nil {
+		return "", "", false
+	}
+	if _, err := io.ReadFull(r, b[:1]); err != nil {
+		return "", "", false
+	}
+	p := make([]byte, b[0])
+	if _, err := io.ReadFull(r, p); err != nil {
+		return "", "", false
+	}
+	return string(u), string(p), true
+}
+
+// startTarget runs a server that sends greeting, then echoes.
+func startTarget(t *testing.T, greeting string) string {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+	go func() {
+		for {
+			c, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer c.Close()
+				c.Write([]byte(greeting))
+				io.Copy(c, c)
+			}()
+		}
+	}()
+	return ln.Addr().String()
+}
+
+// closedAddr returns a local address nothing listens on.
+func closedAddr(t *testing.T) string {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := ln.Addr().String()
+	ln.Close()
+	return addr
+}
+
+// expectGreeting reads len(want) bytes from conn and compares them.
+func expectGreeting(t *testing.T, conn net.Conn, want string) {
+	t.Helper()
+	conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	got := make([]byte, len(want))
+	if _, err := io.ReadFull(conn, got); err != nil {
+		t.Fatalf("reading relayed data: %v", err)
+	}
+	if string(got) != want {
+		t.Fatalf("relayed data = %q, want %q", got, want)
+	}
+}
+
+const testTimeout = 2 * time.Second
+
+func TestDialViaSOCKS5(t *testing.T) {
+	target := startTarget(t, "hello")
+	px := (&fakeUpstream{}).start(t)
+
+	conn, err := dialVia(context.Background(), px, target, testTimeout)
+	if err != nil {
+		t.Fatalf("dialVia: %v", err)
+	}
+	defer conn.Close()
+	expectGreeting(t, conn, "hello")
+
+	conn.Write([]byte("ping"))
+	expectGreeting(t, conn, "ping")
+}
+
+func TestDialViaSOCKS5Auth(t *testing.T) {
+	target := startTarget(t, "hello")
+	up := &fakeUpstream{user: "alice", pass: "s3cret"}
+	px := up.start(t)
+
+	conn, err := dialVia(context.Background(), px, target, testTimeout)
+	if err != nil {
+		t.Fatalf("dialVia with the right credentials: %v", err)
+	}
+	expectGreeting(t, conn, "hello")
+	conn.Close()
+
+	px.Pass = "wrong"
+	if _, err := dialVia(context.Background(), px, target, testTimeout); err == nil || !strings.Contains(err.Error(), "auth rejected") {
+		t.Fatalf("dialVia with a wrong password: err = %v, want auth rejected", err)
+	}
+
+	px.User, px.Pass = "", ""
+	if _, err := dialVia(context.Background(), px, target, testTimeout); err == nil {
+		t.Fatal("dialVia without credentials succeeded against an auth-only proxy")
+	}
+}
+
+func TestDialViaSOCKS5Unreachable(t *testing.T) {
+	px := (&fakeUpstream{}).start(t)
+
+	_, err := dialVia(context.Background(), px, closedAddr(t), testTimeout)
+	var re *replyError
+	if !errors.As(err, &re) {
+		t.Fatalf("err = %v (%T), want *replyError", err, err)
+	}
+	if re.code != replyRefused {
+		t.Fatalf("reply code = %d, want %d", re.code, replyRefused)
+	}
+	if got := replyCode(err); got != replyRefused {
+		t.Fatalf("replyCode = %d, want %d", got, replyRefused)
+	}
+}
+
+func TestDialViaSOCKS5BadReply(t *testing.T) {
+	tests := []struct {
+		name  string
+		reply []byte
+	}{
+		{"empty", []byte{}},
+		{"truncated header", []byte{socks5Version, 0x00}},
+		{"truncated ipv4", []byte{socks5Version, 0x00, 0x00, atypIPv4, 127, 0}},
+		{"truncated port", []byte{socks5Version, 0x00, 0x00, atypIPv4, 127, 0, 0, 1, 0x04}},
+		{"truncated domain", []byte{socks5Version, 0x00, 0x00, atypDomain, 9, 'e', 'x'}},
+		{"wrong version", []byte{0x04, 0x00, 0x00, atypIPv4, 0, 0, 0, 0, 0, 0}},
+		{"bad address type", []byte{socks5Version, 0x00, 0x00, 0x09, 0, 0, 0, 0, 0, 0}},
+	}
+	target := startTarget(t, "hello")
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			px := (&fakeUpstream{reply: tt.reply}).start(t)
+			conn, err := dialVia(context.Background(), px, target, testTimeout)
+			if err == nil {
+				conn.Close()
+				t.Fatal("dialVia succeeded on a malformed reply")
+			}
+			var re *replyError
+			if errors.As(err, &re) {
+				t.Fatalf("err = %v, a malformed reply is not an upstream verdict", err)
+			}
+		})
+	}
+}
+
+func TestDialChain(t *testing.T) {
+	target := startTarget(t, "hello")
+	first := (&fakeUpstream{}).start(t)
+	second := (&fakeUpstream{user: "bob", pass: "pw"}).start(t)
+
+	conn, err := dialChain(context.Background(), []Proxy{first, second}, target, testTimeout)
+	if err != nil {
+		t.Fatalf("dialChain: %v", err)
+	}
+	expectGreeting(t, conn, "hello")
+	conn.Close()
+
+	// A failure at the second hop names it
+	second.Pass = "wrong"
+	_, err = dialChain(context.Background(), []Proxy{first, second}, target, testTimeout)
+	var he *hopError
+	if !errors.As(err, &he) || he.hop.Addr() != second.Addr() {
+		t.Fatalf("err = %v, want a hopError for %s", err, second.Addr())
+	}
+}
+
+func TestConnectSOCKS5SplitReply(t *testing.T) {
+	tests := []struct {
+		name string
+		bnd  []byte
+	}{
+		{"ipv4", []byte{atypIPv4, 10, 1, 2, 3, 0x1f, 0x90}},
+		{"ipv6", append(append([]byte{atypIPv6}, net.ParseIP("2001:db8::7")...), 0x04, 0x38)},
+		{"domain", append(append([]byte{atypDomain, 16}, "bound.example.na"...), 0x00, 0x50)},
+	}
+	target := startTarget(t, "hello")
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			px := (&fakeUpstream{bnd: tt.bnd, split: true}).start(t)
+			conn, err := dialVia(context.Background(), px, target, testTimeout)
+			if err != nil {
+				t.Fatalf("dialVia: %v", err)
+			}
+			defer conn.Close()
+			// Any BND byte left unread would come before the greeting
+			expectGreeting(t, conn, "hello")
+			conn.Write([]byte("ping"))
+			expectGreeting(t, conn, "ping")
+		})
+	}
+}
+
+func TestParseTarget(t *testing.T) {
+	// req builds a CONNECT request with the given ATYP and address bytes
+	req := func(atyp byte, addr ...byte) []byte {
+		return append([]byte{socks5Version, cmdConnect, 0x00, atyp}, addr...)
+	}
+	long := strings.Repeat("a", 255)
+	ipv6 := net.ParseIP("2001:db8::1")
+
+	tests := []struct {
+		name    string
+		buf     []byte
+		want    string
+		wantErr string
+	}{
+		{"ipv4", req(atypIPv4, 10, 0, 0, 1, 0x01, 0xbb), "10.0.0.1:443", ""},
+		{"ipv6", req(atypIPv6, append(ipv6, 0x00, 0x50)...), "[2001:db8::1]:80", ""},
+		{"ipv4-mapped ipv6", req(atypIPv6, append(net.ParseIP("::ffff:10.0.0.1").To16(), 0x00, 0x50)...), "10.0.0.1:80", ""},
+		{"domain", req(atypDomain, append([]byte{11}, "example.com\x00\x50"...)...), "example.com:80", ""},
+		{"255-byte domain", req(atypDomain, append(append([]byte{255}, long...), 0x1f, 0x90)...), long + ":8080", ""},
+		{"empty domain", req(atypDomain, 0, 0x00, 0x50), "", "empty domain"},
+
+		{"too short", []byte{socks5Version, cmdConnect, 0x00, atypIPv4, 1, 2}, "", "request too short"},
+		{"truncated ipv4", req(atypIPv4, 10, 0, 0, 1, 0x01), "", "ipv4 request too short"},
+		{"truncated ipv6", req(atypIPv6, append(ipv6[:15:15], 0x00)...), "", "ipv6 request too short"},
+		{"truncated ipv6 port", req(atypIPv6, append(ipv6, 0x00)...), "", "ipv6 request too short"},
+		{"truncated domain", req(atypDomain, append([]byte{11}, "example.co"...)...), "", "domain request too short"},
+		{"truncated domain port", req(atypDomain, append([]byte{11}, "example.com\x00"...)...), "", "domain request too short"},
+		{"truncated 255-byte domain", req(atypDomain, append(append([]byte{255}, long[:254]...), 0x1f, 0x90)...), "", "domain request too short"},
+		{"unknown atyp", req(0x09, 0, 0, 0, 0, 0, 0), "", "unsupported address type"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := parseTarget(tt.buf)
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("parseTarget = %q, %v; want error %q", got, err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("parseTarget: %v", err)
+			}
+			if got != tt.want {
+				t.Fatalf("parseTarget = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+// tcpPair returns the two ends of a loopback TCP connection.
+func tcpPair(t *testing.T) (*net.TCPConn, *net.TCPConn) {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	accepted := make(chan net.Conn, 1)
+	go func() {
+		c, _ := ln.Accept()
+		accepted <- c
+	}()
+	a, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	b := <-accepted
+	if b == nil {
+		t.Fatal("accept failed")
+	}
+	t.Cleanup(func() { a.Close(); b.Close() })
+	return a.(*net.TCPConn), b.(*net.TCPConn)
+}
+
+type relayResult struct{ up, down int64 }
+
+// startRelay runs relay between a client and a server pair and returns
+// the client's end, the server's end and the relay's result.
+func startRelay(t *testing.T, idle time.Duration) (client, server *net.TCPConn, res chan relayResult) {
+	t.Helper()
+	client, left := tcpPair(t)
+	right, server := tcpPair(t)
+	res = make(chan relayResult, 1)
+	go func() {
+		up, down := relay(left, right, idle, newBufferPool(32*1024))
+		res <- relayResult{up, down}
+	}()
+	return client, server, res
+}
+
+func TestRelayUploadAfterHalfClose(t *testing.T) {
+	client, server, res := startRelay(t, 0)
+
+	upload := make([]byte, 8<<20)
+	for i := range upload {
+		upload[i] = byte(i*7 + i>>8)
+	}
+	response := []byte("200 OK, send the file")
+
+	// The server answers and half-closes first, as with a request
+	// whose response is complete before the upload is
+	server.Write(response)
+	server.CloseWrite()
+
+	client.SetReadDeadline(time.Now().Add(5 * time.Second))
+	got, err := io.ReadAll(client)
+	if err != nil || string(got) != string(response) {
+		t.Fatalf("client read %q, %v; want %q", got, err, response)
+	}
+
+	received := make(chan []byte, 1)
+	go func() {
+		server.SetReadDeadline(time.Now().Add(10 * time.Second))
+		b, _ := io.ReadAll(server)
+		received <- b
+		server.Close()
+	}()
+	if _, err := client.Write(upload); err != nil {
+		t.Fatalf("upload: %v", err)
+	}
+	client.CloseWrite()
+
+	if b := <-received; len(b) != len(upload) || string(b) != string(upload) {
+		t.Fatalf("server received %d bytes, want all %d intact", len(b), len(upload))
+	}
+	select {
+	case r := <-res:
+		if r.up != int64(len(upload)) || r.down != int64(len(response)) {
+			t.Fatalf("relay counted up %d, down %d; want %d, %d", r.up, r.down, len(upload), len(response))
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("relay did not return after both sides closed")
+	}
+}
+
+func TestRelayNoLeakWhenPeerNeverCloses(t *testing.T) {
+	const idle = 200 * time.Millisecond
+	baseline := runtime.NumGoroutine()
+	client, server, res := startRelay(t, idle)
+
+	// The server finishes; the client neither sends nor closes
+	server.Write([]byte("bye"))
+	server.CloseWrite()
+	expectGreeting(t, client, "bye")
+
+	start := time.Now()
+	select {
+	case <-res:
+	case <-time.After(idle + 2*time.Second):
+		t.Fatalf("relay still running %s after one side finished", time.Since(start))
+	}
+
+	// Both copy goroutines and the relay's own have exited
+	deadline := time.Now().Add(2 * time.Second)
+	for runtime.NumGoroutine() > baseline {
+		if time.Now().After(deadline) {
+			buf := make([]byte, 1<<16)
+			t.Fatalf("%d goroutines, baseline %d:\n%s", runtime.NumGoroutine(), baseline, buf[:runtime.Stack(buf, true)])
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestDialUpstreamResolveFailureFallsBackDirect(t *testing.T) {
+	for _, allowDirect := range []bool{false, true} {
+		s := &Server{pool: NewProxyPool(&Config{}), dialTimeout: testTimeout, resolve: ResolveLocal, allowDirect: allowDirect}
+		// .invalid never resolves (RFC 2606), so both paths fail; the
+		// upstream returned tells whether a direct dial was tried
+		conn, upstream, err := s.dialUpstream("test", "host.invalid:80")
+		if err == nil {
+			conn.Close()
+			t.Fatal("dialUpstream to host.invalid succeeded")
+		}
+		if direct := upstream.Scheme == directUpstream.Scheme; direct != allowDirect {
+			t.Errorf("allowDirect %v: upstream = %v; want direct %v", allowDirect, upstream, allowDirect)
+		}
+	}
+}
+
+// relayIOCopy is relay as it was before bufferPool: io.Copy each way,
+// allocating a fresh 32 KiB buffer per direction.
+func relayIOCopy(left, right net.Conn) {
+	defer left.Close()
+	defer right.Close()
+	done := make(chan struct{}, 2)
+	go func() { io.Copy(left, right); done <- struct{}{} }()
+	go func() { io.Copy(right, left); done <- struct{}{} }()
+	<-done
+	<-done
+}
+
+// BenchmarkRelay relays a short upload per op over net.Pipe pairs, the
+// churn of many small connections.
+func BenchmarkRelay(b *testing.B) {
+	payload := make([]byte, 4096)
+	run := func(b *testing.B, relayFn func(left, right net.Conn)) {
+		b.ReportAllocs()
+		b.SetBytes(int64(len(payload)))
+		buf := make([]byte, len(payload))
+		for i := 0; i < b.N; i++ {
+			client, left := net.Pipe()
+			right, server := net.Pipe()
+			done := make(chan struct{})
+			go func() {
+				relayFn(left, right)
+				close(done)
+			}()
+			go func() {
+				client.Write(payload)
+				client.Close()
+			}()
+			if _, err := io.ReadFull(server, buf); err != nil {
+				b.Fatal(err)
+			}
+			server.Close()
+			<-done
+		}
+	}
+	b.Run("bufferPool", func(b *testing.B) {
+		bufs := newBufferPool(32 * 1024)
+		run(b, func(left, right net.Conn) { relay(left, right, 0, bufs) })
+	})
+	b.Run("io.Copy", func(b *testing.B) {
+		run(b, relayIOCopy)
+	})
+}
+
+func TestServerDualStack(t *testing.T) {
+	target, err := net.Listen("tcp", "[::1]:0")
+	if err != nil {
+		t.Skipf("IPv6 unavailable: %v", err)
+	}
+	t.Cleanup(func() { target.Close() })
+	go func() {
+		for {
+			c, err := target.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer c.Close()
+				c.Write([]byte("hello"))
+				io.Copy(c, c)
+			}()
+		}
+	}()
+
+	pool := NewProxyPool(&Config{})
+	pool.Update([]Proxy{(&fakeUpstream{}).start(t)}, nil)
+	cfg := &Config{
+		ListenAddr:     "[::]:0",
+		DialTimeout:    testTimeout,
+		ChainLength:    1,
+		ConnectRetries: 1,
+		Resolve:        ResolveRemote,
+		RelayBuffer:    32 * 1024,
+		// fakeUpstream never half-closes to the target, so let relays
+		// time out quickly rather than hold up Shutdown
+		RelayIdleTimeout: 200 * time.Millisecond,
+	}
+	server := NewServer(cfg, pool)
+	go server.Start()
+	t.Cleanup(func() { server.Shutdown(context.Background()) })
+	select {
+	case <-server.Ready():
+	case <-time.After(testTimeout):
+		t.Fatal("server didn't start")
+	}
+	port := strconv.Itoa(server.Addr().(*net.TCPAddr).Port)
+
+	for _, ip := range []string{"127.0.0.1", "::1"} {
+		t.Run(ip, func(t *testing.T) {
+			self := Proxy{Scheme: SchemeSOCKS5, IP: ip, Port: port}
+			conn, err := dialVia(context.Background(), self, target.Addr().String(), testTimeout)
+			if err != nil {
+				t.Fatalf("CONNECT %s via [%s]:%s: %v", target.Addr(), ip, port, err)
+			}
+			defer conn.Close()
+			expectGreeting(t, conn, "hello")
+			conn.Write([]byte("ping"))
+			expectGreeting(t, conn, "ping")
+		})
+	}
+}
+
+func TestSOCKS5HandshakeAuthTooLong(t *testing.T) {
+	client, peer := net.Pipe()
+	defer client.Close()
+	defer peer.Close()
+
+	px := Proxy{User: strings.Repeat("u", maxAuthLen+1), Pass: "p"}
+	if err := socks5Handshake(client, px); err == nil {
+		t.Fatal("socks5Handshake accepted a 256-byte user")
+	}
+	// Nothing may reach the upstream, not even the greeting
+	peer.SetReadDeadline(time.Now().Add(50 * time.Millisecond))
+	if n, err := peer.Read(make([]byte, 1)); n != 0 || err == nil {
+		t.Fatalf("upstream read %d bytes, err %v; want nothing", n, err)
+	}
+}
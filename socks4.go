@@ -0,0 +1,87 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"time"
+)
+
+const (
+	socks4Version  = 0x04
+	socks4Granted  = 0x5a
+	socks4Rejected = 0x5b
+)
+
+// handleSOCKS4 serves a SOCKS4/4a CONNECT. The version byte has
+// already been consumed by handleConn. Upstream dialing and relaying
+// share the SOCKS5 path.
+func (s *Server) handleSOCKS4(conn net.Conn) {
+	// CD, DSTPORT, DSTIP
+	req := make([]byte, 7)
+	if _, err := io.ReadFull(conn, req); err != nil {
+		return
+	}
+	if _, err := readNullTerminated(conn); err != nil { // USERID, unused
+		return
+	}
+
+	// SOCKS4 has no passwords, so it can't satisfy configured auth
+	if req[0] != cmdConnect || len(s.Credentials) > 0 || !s.allowClient(conn) {
+		sendSOCKS4Reply(conn, socks4Rejected)
+		return
+	}
+
+	port := int(req[1])<<8 | int(req[2])
+	ip := net.IP(req[3:7])
+	host := ip.String()
+
+	// SOCKS4a: 0.0.0.x (x != 0) means a domain name follows the userid
+	if ip[0] == 0 && ip[1] == 0 && ip[2] == 0 && ip[3] != 0 {
+		domain, err := readNullTerminated(conn)
+		if err != nil || domain == "" {
+			sendSOCKS4Reply(conn, socks4Rejected)
+			return
+		}
+		host = domain
+	}
+
+	target := net.JoinHostPort(host, strconv.Itoa(port))
+	entry := AccessEntry{Client: conn.RemoteAddr().String(), Target: target, Start: time.Now()}
+	remote, upstream, err := s.dialUpstream(clientIP(conn), target)
+	entry.Upstream = upstreamLabel(upstream)
+	if err != nil {
+		sendSOCKS4Reply(conn, socks4Rejected)
+		entry.Err = err
+		s.AccessLog.Log(entry)
+		return
+	}
+	defer s.pool.Release(upstream.Addr())
+	sendSOCKS4Reply(conn, socks4Granted)
+	entry.BytesUp, entry.BytesDown = relay(conn, remote, s.idleTimeout, s.relayBufs)
+	s.addTraffic(entry.BytesUp, entry.BytesDown)
+	s.AccessLog.Log(entry)
+}
+
+// sendSOCKS4Reply writes VN=0, status, and an ignored port/IP.
+func sendSOCKS4Reply(conn net.Conn, status byte) {
+	conn.Write([]byte{0x00, status, 0, 0, 0, 0, 0, 0})
+}
+
+// readNullTerminated reads a NUL-terminated string of at most 255 bytes.
+func readNullTerminated(r io.Reader) (string, error) {
+	var buf bytes.Buffer
+	b := make([]byte, 1)
+	for buf.Len() <= 255 {
+		if _, err := io.ReadFull(r, b); err != nil {
+			return "", err
+		}
+		if b[0] == 0x00 {
+			return buf.String(), nil
+		}
+		buf.WriteByte(b[0])
+	}
+	return "", fmt.Errorf("string too long")
+}
@@ -0,0 +1,159 @@
+package main
+
+import (
+	"bufio"
+	"compress/flate"
+	"compress/gzip"
+	"compress/zlib"
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// Source supplies candidate proxies for a pool refresh. Implementations
+// also implement fmt.Stringer for logs.
+type Source interface {
+	Fetch(ctx context.Context) ([]Proxy, error)
+	String() string
+}
+
+// NewSource picks a Source for a -url value: http(s):// URLs are
+// scraped, file:// URLs and plain paths are read from disk.
+func NewSource(raw string, cfg *Config) Source {
+	if path, ok := strings.CutPrefix(raw, "file://"); ok {
+		return &fileSource{path: path, format: cfg.Format}
+	}
+	if strings.HasPrefix(raw, "http://") || strings.HasPrefix(raw, "https://") {
+		return &httpSource{url: raw, cfg: cfg, client: cfg.ScrapeClient}
+	}
+	return &fileSource{path: raw, format: cfg.Format}
+}
+
+// DefaultUserAgent is sent to list hosts unless -user-agent is set;
+// some block Go's default client string.
+const DefaultUserAgent = "Mozilla/5.0 (compatible; socks5-pool)"
+
+// newScrapeClient builds the client shared by every httpSource, so
+// connections are reused across sources and refreshes. Idle ones are
+// kept past -scrape-interval, so where the list host keeps them open
+// too the next refresh skips the TLS handshake, over HTTP/2 if offered.
+// Each fetch is bounded by -scrape-timeout through its context.
+func newScrapeClient(cfg *Config) *http.Client {
+	return &http.Client{Transport: &http.Transport{
+		Proxy:               http.ProxyFromEnvironment,
+		DialContext:         (&net.Dialer{Timeout: 30 * time.Second, KeepAlive: 30 * time.Second}).DialContext,
+		ForceAttemptHTTP2:   true,
+		TLSHandshakeTimeout: 10 * time.Second,
+		MaxIdleConns:        16,
+		MaxIdleConnsPerHost: max(cfg.ScrapeHostConns, 2),
+		MaxConnsPerHost:     cfg.ScrapeHostConns,
+		IdleConnTimeout:     cfg.ScrapeInterval + time.Minute,
+	}}
+}
+
+// httpSource fetches a proxy list with the configured User-Agent and
+// headers and parses it according to cfg.Format.
+type httpSource struct {
+	url    string
+	cfg    *Config
+	client *http.Client
+}
+
+func (s *httpSource) String() string { return redactURL(s.url) }
+
+func (s *httpSource) Fetch(ctx context.Context) ([]Proxy, error) {
+	// The deadline covers the body too, so a source that stalls mid-list
+	// fails like one that never answers and the pool is left as is.
+	ctx, cancel := context.WithTimeout(ctx, s.cfg.ScrapeTimeout)
+	defer cancel()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, s.url, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("User-Agent", s.cfg.UserAgent)
+	req.Header.Set("Accept-Encoding", "gzip, deflate")
+	for name, values := range s.cfg.ScrapeHeaders {
+		req.Header[name] = values
+	}
+
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("fetch failed: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("unexpected status: %d", resp.StatusCode)
+	}
+
+	body, err := decodeBody(resp)
+	if err != nil {
+		return nil, fmt.Errorf("decode body failed: %w", err)
+	}
+	defer body.Close()
+
+	// Auto mode takes the server's word for JSON
+	format := s.cfg.Format
+	if format == FormatAuto && isJSONType(resp.Header.Get("Content-Type")) {
+		format = FormatJSON
+	}
+	proxies, err := parseList(body, format)
+	if err != nil {
+		return nil, fmt.Errorf("read body failed: %w", err)
+	}
+	return proxies, nil
+}
+
+// decodeBody undoes the response's Content-Encoding. Setting
+// Accept-Encoding ourselves turns off the transport's own gzip
+// handling, so gzip and deflate are decoded here. HTTP "deflate" is
+// meant to be zlib-wrapped, but some servers send raw DEFLATE; the
+// zlib header is sniffed to tell them apart.
+func decodeBody(resp *http.Response) (io.ReadCloser, error) {
+	if resp.Uncompressed {
+		return resp.Body, nil
+	}
+	switch strings.ToLower(strings.TrimSpace(resp.Header.Get("Content-Encoding"))) {
+	case "", "identity":
+		return resp.Body, nil
+	case "gzip", "x-gzip":
+		return gzip.NewReader(resp.Body)
+	case "deflate":
+		br := bufio.NewReader(resp.Body)
+		if hdr, err := br.Peek(2); err == nil && (uint16(hdr[0])<<8|uint16(hdr[1]))%31 == 0 && hdr[0]&0x0f == 8 {
+			return zlib.NewReader(br)
+		}
+		return flate.NewReader(br), nil
+	default:
+		return nil, fmt.Errorf("unsupported Content-Encoding %q", resp.Header.Get("Content-Encoding"))
+	}
+}
+
+// fileSource reads a proxy list from a local file on every refresh, so
+// it can be edited while the pool runs.
+type fileSource struct {
+	path   string
+	format string
+}
+
+func (s *fileSource) String() string { return "file://" + s.path }
+
+func (s *fileSource) Fetch(ctx context.Context) ([]Proxy, error) {
+	f, err := os.Open(s.path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	format := s.format
+	if format == FormatAuto && strings.EqualFold(filepath.Ext(s.path), ".json") {
+		format = FormatJSON
+	}
+	return parseList(f, format)
+}
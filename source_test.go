@@ -0,0 +1,92 @@
+package main
+
+import (
+	"bytes"
+	"compress/flate"
+	"compress/gzip"
+	"compress/zlib"
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+const testList = "socks5://1.2.3.4:1080\nsocks5://5.6.7.8:1081\n"
+
+func compress(t *testing.T, newWriter func(io.Writer) io.WriteCloser) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	w := newWriter(&buf)
+	if _, err := io.WriteString(w, testList); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+// fetchEncoded serves body with the given Content-Encoding and fetches
+// it through an httpSource.
+func fetchEncoded(t *testing.T, encoding string, body []byte) ([]Proxy, error) {
+	t.Helper()
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain")
+		w.Header().Set("Content-Encoding", encoding)
+		w.Write(body)
+	}))
+	t.Cleanup(srv.Close)
+	src := &httpSource{url: srv.URL, cfg: &Config{Format: FormatAuto, ScrapeTimeout: testTimeout}, client: srv.Client()}
+	return src.Fetch(context.Background())
+}
+
+func TestFetchDecodesBody(t *testing.T) {
+	tests := []struct {
+		name     string
+		encoding string
+		body     []byte
+	}{
+		{"identity", "", []byte(testList)},
+		{"gzip", "gzip", compress(t, func(w io.Writer) io.WriteCloser { return gzip.NewWriter(w) })},
+		{"deflate zlib", "deflate", compress(t, func(w io.Writer) io.WriteCloser { return zlib.NewWriter(w) })},
+		{"deflate raw", "deflate", compress(t, func(w io.Writer) io.WriteCloser {
+			fw, _ := flate.NewWriter(w, flate.DefaultCompression)
+			return fw
+		})},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			proxies, err := fetchEncoded(t, tt.encoding, tt.body)
+			if err != nil {
+				t.Fatalf("Fetch: %v", err)
+			}
+			var got []string
+			for _, px := range proxies {
+				got = append(got, px.Addr())
+			}
+			if len(got) != 2 || got[0] != "1.2.3.4:1080" || got[1] != "5.6.7.8:1081" {
+				t.Errorf("proxies = %v; want [1.2.3.4:1080 5.6.7.8:1081]", got)
+			}
+		})
+	}
+}
+
+func TestFetchCorruptGzip(t *testing.T) {
+	gz := compress(t, func(w io.Writer) io.WriteCloser { return gzip.NewWriter(w) })
+	tests := []struct {
+		name string
+		body []byte
+	}{
+		{"bad header", []byte("definitely not gzip")},
+		{"truncated", gz[:len(gz)-6]},
+		{"bad checksum", append(append([]byte{}, gz[:len(gz)-8]...), 0, 0, 0, 0, 0, 0, 0, 0)},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if proxies, err := fetchEncoded(t, "gzip", tt.body); err == nil {
+				t.Errorf("Fetch = %v, nil; want an error", proxies)
+			}
+		})
+	}
+}
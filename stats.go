@@ -0,0 +1,146 @@
+package main
+
+import "time"
+
+// ProxyStats tracks reliability for one proxy across refresh cycles.
+// Health checks and relays both count as checks.
+type ProxyStats struct {
+	Checks      int
+	Successes   int
+	LastSeen    time.Time // last successful check or relay
+	LastError   string    // why the last failed check or relay failed
+	LastErrorAt time.Time
+}
+
+// SuccessRate returns the fraction of successful checks, 0 if unchecked.
+func (s ProxyStats) SuccessRate() float64 {
+	if s.Checks == 0 {
+		return 0
+	}
+	return float64(s.Successes) / float64(s.Checks)
+}
+
+// statsFor returns the stats entry for addr, creating it if needed.
+// Caller holds p.mu.
+func (p *ProxyPool) statsFor(addr string) *ProxyStats {
+	st, ok := p.stats[addr]
+	if !ok {
+		st = &ProxyStats{}
+		p.stats[addr] = st
+	}
+	return st
+}
+
+// noteErrorLocked records err as addr's last error. Caller holds p.mu.
+func (p *ProxyPool) noteErrorLocked(addr string, err error) {
+	if err == nil {
+		return
+	}
+	st := p.statsFor(addr)
+	st.LastError = err.Error()
+	st.LastErrorAt = time.Now()
+}
+
+// RecordChecks folds a health-check batch into the stats: every checked
+// proxy gets a check, alive ones a success, and those in failed their
+// reason as the last error. Stats for proxies that are neither in the
+// batch nor in the pool are dropped to bound memory.
+func (p *ProxyPool) RecordChecks(checked, alive []Proxy, failed map[string]error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	now := time.Now()
+	keep := make(map[string]bool, len(checked)+len(p.proxies))
+	for _, px := range checked {
+		keep[px.Addr()] = true
+		p.statsFor(px.Addr()).Checks++
+	}
+	for _, px := range alive {
+		st := p.statsFor(px.Addr())
+		st.Successes++
+		st.LastSeen = now
+	}
+	for addr, err := range failed {
+		p.noteErrorLocked(addr, err)
+	}
+	for _, px := range p.proxies {
+		keep[px.Addr()] = true
+	}
+	for addr := range p.stats {
+		if !keep[addr] {
+			delete(p.stats, addr)
+		}
+	}
+}
+
+// Stats returns a copy of the stats for every tracked proxy.
+func (p *ProxyPool) Stats() map[string]ProxyStats {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	out := make(map[string]ProxyStats, len(p.stats))
+	for addr, st := range p.stats {
+		out[addr] = *st
+	}
+	return out
+}
+
+// WeightedNext picks a proxy at random, with probability proportional
+// to its success rate and inversely proportional to its latency.
+// Success rates are smoothed so unchecked proxies still get a share,
+// and proxies without a latency measurement count as 1s.
+func (p *ProxyPool) WeightedNext() (Proxy, bool) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	defer p.publishLocked()
+
+	weights := make([]float64, len(p.proxies))
+	var total float64
+	for i, px := range p.proxies {
+		if p.blacklist[px.Addr()] || p.skipUnpinnedLocked(px.Addr()) {
+			continue
+		}
+		weights[i] = proxyWeight(px, p.stats[px.Addr()])
+		total += weights[i]
+	}
+	if total == 0 {
+		return Proxy{}, false
+	}
+
+	r := p.rng.Float64() * total
+	for i, w := range weights {
+		if w == 0 {
+			continue
+		}
+		if r < w {
+			p.current = i
+			return p.proxies[i], true
+		}
+		r -= w
+	}
+	// Float rounding: fall back to the last eligible proxy
+	for i := len(weights) - 1; i >= 0; i-- {
+		if weights[i] > 0 {
+			p.current = i
+			return p.proxies[i], true
+		}
+	}
+	return Proxy{}, false
+}
+
+// proxyWeight is (successes+1)/(checks+2) divided by latency in
+// seconds, with latency floored at 10ms so one very fast proxy
+// doesn't take all the traffic.
+func proxyWeight(px Proxy, st *ProxyStats) float64 {
+	rate := 0.5
+	if st != nil {
+		rate = float64(st.Successes+1) / float64(st.Checks+2)
+	}
+	latency := px.Latency
+	if latency <= 0 {
+		latency = time.Second
+	}
+	if latency < 10*time.Millisecond {
+		latency = 10 * time.Millisecond
+	}
+	return rate / latency.Seconds()
+}
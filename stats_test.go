@@ -0,0 +1,55 @@
+package main
+
+import (
+	"math"
+	"math/rand"
+	"testing"
+	"time"
+)
+
+func TestWeightedNextDistribution(t *testing.T) {
+	p := NewProxyPool(&Config{})
+	p.rng = rand.New(rand.NewSource(1))
+	fast := testProxy("10.0.0.1", 50*time.Millisecond)
+	slow := testProxy("10.0.0.2", 200*time.Millisecond)
+	flaky := testProxy("10.0.0.3", 50*time.Millisecond)
+	banned := testProxy("10.0.0.4", 10*time.Millisecond)
+	all := []Proxy{fast, slow, flaky, banned}
+	p.Update(all, nil)
+	for range 4 {
+		p.RecordChecks([]Proxy{fast, slow, flaky}, []Proxy{fast, slow}, nil)
+	}
+	// Set directly: Remove would also take it out of the pool, and
+	// WeightedNext has to skip blacklisted entries still listed
+	p.mu.Lock()
+	p.blacklist[banned.Addr()] = true
+	p.mu.Unlock()
+
+	stats := p.Stats()
+	want := make(map[string]float64)
+	var total float64
+	for _, px := range all[:3] {
+		st := stats[px.Addr()]
+		want[px.Addr()] = proxyWeight(px, &st)
+		total += want[px.Addr()]
+	}
+
+	const draws = 10000
+	got := make(map[string]int)
+	for range draws {
+		px, ok := p.WeightedNext()
+		if !ok {
+			t.Fatal("WeightedNext found no proxy")
+		}
+		if px.Addr() == banned.Addr() {
+			t.Fatalf("WeightedNext picked blacklisted %s", px)
+		}
+		got[px.Addr()]++
+	}
+	for addr, w := range want {
+		share := float64(got[addr]) / draws
+		if math.Abs(share-w/total) > 0.02 {
+			t.Errorf("%s picked %.3f of the time; want %.3f", addr, share, w/total)
+		}
+	}
+}
@@ -1,71 +1,270 @@
 package main
 
 import (
+	"crypto/subtle"
+	"crypto/tls"
+	"encoding/csv"
 	"encoding/json"
+	"errors"
+	"fmt"
 	"html/template"
+	"io"
+	"net"
 	"net/http"
+	"slices"
+	"sort"
 	"strconv"
+	"strings"
 	"time"
 )
 
 type StatusServer struct {
-	pool *ProxyPool
+	cfg    *Config
+	pool   *ProxyPool
+	server *Server
+	events *eventHub
 }
 
 type StatusData struct {
-	Total        int           `json:"total"`
-	ActiveProxy  string        `json:"active_proxy"`
-	ActiveRegion string        `json:"active_region"`
-	LastScrape   string        `json:"last_scrape"`
-	NextScrape   string        `json:"next_scrape"`
-	Proxies      []ProxyStatus `json:"proxies"`
+	Total          int             `json:"total"`
+	ActiveProxy    string          `json:"active_proxy"`
+	ActiveRegion   string          `json:"active_region"`
+	LastScrape     string          `json:"last_scrape"`
+	NextScrape     string          `json:"next_scrape"`
+	Timezone       string          `json:"timezone"`
+	CheckHost      string          `json:"check_host"`
+	ActiveConns    int64           `json:"active_conns"`
+	MaxConns       int             `json:"max_conns"`
+	TotalConns     int64           `json:"total_conns"`
+	BytesUp        int64           `json:"bytes_up"`
+	BytesDown      int64           `json:"bytes_down"`
+	LatencyBuckets []LatencyBucket `json:"latency_buckets"`
+	Proxies        []ProxyStatus   `json:"proxies"`
+}
+
+// LatencyBucket counts pooled proxies whose check latency falls in one
+// range. Percent is the share of proxies with a measured latency.
+type LatencyBucket struct {
+	Label   string `json:"label"`
+	Count   int    `json:"count"`
+	Percent int    `json:"percent"`
+}
+
+// latencyBounds are the upper edges of the histogram buckets, with
+// labels for each plus a final open-ended bucket.
+var (
+	latencyBounds = []time.Duration{100 * time.Millisecond, 300 * time.Millisecond, time.Second}
+	latencyLabels = []string{"<100ms", "100-300ms", "300ms-1s", ">1s"}
+)
+
+// latencyHistogram buckets the measured latencies of proxies. Proxies
+// without one (latency 0) aren't counted.
+func latencyHistogram(proxies []Proxy) []LatencyBucket {
+	hist := make([]LatencyBucket, len(latencyLabels))
+	for i, label := range latencyLabels {
+		hist[i].Label = label
+	}
+	measured := 0
+	for _, p := range proxies {
+		if p.Latency <= 0 {
+			continue
+		}
+		i := sort.Search(len(latencyBounds), func(i int) bool { return p.Latency < latencyBounds[i] })
+		hist[i].Count++
+		measured++
+	}
+	if measured > 0 {
+		for i := range hist {
+			hist[i].Percent = hist[i].Count * 100 / measured
+		}
+	}
+	return hist
 }
 
 type ProxyStatus struct {
-	Addr    string `json:"addr"`
-	Country string `json:"country"`
-	City    string `json:"city"`
-	Active  bool   `json:"active"`
+	Index       int      `json:"index"` // position in the pool, for /api/switch
+	Addr        string   `json:"addr"`
+	Country     string   `json:"country"`
+	CountryCode string   `json:"country_code"`
+	City        string   `json:"city"`
+	LatencyMs   int64    `json:"latency_ms"`
+	SuccessRate float64  `json:"success_rate"`
+	Checks      int      `json:"checks"`
+	Anonymity   string   `json:"anonymity"`
+	Conns       int      `json:"conns"`   // active relays through this proxy
+	Breaker     string   `json:"breaker"` // circuit state: closed, open or half-open
+	VerifiedAt  string   `json:"verified_at"`
+	LastError   string   `json:"last_error,omitempty"` // most recent failed check or relay
+	LastErrorAt string   `json:"last_error_at,omitempty"`
+	Pinned      bool     `json:"pinned"`
+	Tags        []string `json:"tags,omitempty"`
+	Active      bool     `json:"active"`
 }
 
-func NewStatusServer(pool *ProxyPool) *StatusServer {
-	return &StatusServer{
-		pool: pool,
+func NewStatusServer(cfg *Config, pool *ProxyPool, server *Server) *StatusServer {
+	s := &StatusServer{
+		cfg:    cfg,
+		pool:   pool,
+		server: server,
+		events: newEventHub(),
 	}
+	pool.OnEvent(s.events.Publish)
+	pool.OnSwitch(func(old, cur Proxy) {
+		ev := PoolEvent{Type: EventActiveSwitched, Time: time.Now(), Total: pool.Size()}
+		// The zero Proxy stands for an empty pool; leave its addr out
+		if cur.IP != "" {
+			ev.Addr = cur.Addr()
+		}
+		if old.IP != "" {
+			ev.Prev = old.Addr()
+		}
+		s.events.Publish(ev)
+	})
+	return s
 }
 
 func (s *StatusServer) Start(addr string) error {
 	mux := http.NewServeMux()
 	mux.HandleFunc("/", s.handleDashboard)
 	mux.HandleFunc("/api/status", s.handleAPI)
-	mux.HandleFunc("/api/refresh", s.handleRefresh)
-	mux.HandleFunc("/api/switch", s.handleSwitch)
-	return http.ListenAndServe(addr, mux)
+	mux.HandleFunc("/api/refresh", sameOriginOnly(s.handleRefresh))
+	mux.HandleFunc("/api/switch", sameOriginOnly(s.handleSwitch))
+	mux.HandleFunc("/api/add", sameOriginOnly(s.handleAdd))
+	mux.HandleFunc("/api/proxy", sameOriginOnly(s.handleProxy))
+	mux.HandleFunc("/api/pin", sameOriginOnly(s.handlePin))
+	mux.HandleFunc("/api/list", s.handleList)
+	mux.HandleFunc("/api/test", sameOriginOnly(s.handleTest))
+	mux.HandleFunc("/api/recheck", sameOriginOnly(s.handleRecheck))
+	mux.HandleFunc("/api/drain", sameOriginOnly(s.handleDrain))
+	mux.HandleFunc("/api/events", s.handleEvents)
+	mux.HandleFunc("/api/nagios", s.handleNagios)
+	mux.HandleFunc("/ws", s.handleWS)
+
+	// Probes stay outside -status-auth so orchestrators can reach them
+	root := http.NewServeMux()
+	root.HandleFunc("/healthz", s.handleHealthz)
+	root.HandleFunc("/readyz", s.handleReadyz)
+	root.Handle("/", s.requireAuth(mux))
+
+	srv := &http.Server{Addr: addr, Handler: root}
+	switch {
+	case s.cfg.StatusCert != "":
+		return srv.ListenAndServeTLS(s.cfg.StatusCert, s.cfg.StatusKey)
+	case s.cfg.StatusSelfSigned:
+		cert, err := selfSignedCert(addr)
+		if err != nil {
+			return fmt.Errorf("self-signed cert: %w", err)
+		}
+		srv.TLSConfig = &tls.Config{Certificates: []tls.Certificate{cert}}
+		return srv.ListenAndServeTLS("", "")
+	}
+	return srv.ListenAndServe()
+}
+
+// handleHealthz is the liveness probe: 200 while the process serves.
+func (s *StatusServer) handleHealthz(w http.ResponseWriter, r *http.Request) {
+	w.Write([]byte("ok\n"))
+}
+
+// handleReadyz is the readiness probe: 503 until the pool has a proxy,
+// and again once draining.
+func (s *StatusServer) handleReadyz(w http.ResponseWriter, r *http.Request) {
+	if s.server.Draining() {
+		http.Error(w, "draining", http.StatusServiceUnavailable)
+		return
+	}
+	if s.pool.Size() == 0 {
+		http.Error(w, "no proxies", http.StatusServiceUnavailable)
+		return
+	}
+	if !s.server.Verified() {
+		http.Error(w, "self-test pending", http.StatusServiceUnavailable)
+		return
+	}
+	w.Write([]byte("ok\n"))
+}
+
+// requireAuth enforces -status-auth on every route, including /ws.
+// Without it configured the dashboard stays open.
+func (s *StatusServer) requireAuth(next http.Handler) http.Handler {
+	if s.cfg.StatusUser == "" {
+		return next
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		user, pass, ok := r.BasicAuth()
+		userOK := subtle.ConstantTimeCompare([]byte(user), []byte(s.cfg.StatusUser)) == 1
+		passOK := subtle.ConstantTimeCompare([]byte(pass), []byte(s.cfg.StatusPass)) == 1
+		if !ok || !userOK || !passOK {
+			w.Header().Set("WWW-Authenticate", `Basic realm="socks5-pool", charset="UTF-8"`)
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// sameOriginOnly guards the routes that change state, some of them
+// GETs, against cross-site requests that ride on a browser's cached
+// -status-auth credentials. A request is refused if its Origin names
+// another host, or if the browser marks it cross-site in
+// Sec-Fetch-Site. curl and scripts send neither and pass.
+func sameOriginOnly(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		site := r.Header.Get("Sec-Fetch-Site")
+		if !sameOrigin(r) || (site != "" && site != "same-origin" && site != "none") {
+			http.Error(w, "cross-origin request refused", http.StatusForbidden)
+			return
+		}
+		next(w, r)
+	}
 }
 
 func (s *StatusServer) getStatusData() StatusData {
 	proxies := s.pool.All()
+	stats := s.pool.Stats()
+	inUse := s.pool.InUse()
+	breakers := s.pool.Breakers()
+	pinned := s.pool.Pinned()
 	activeIdx := s.pool.CurrentIndex()
 	last, next := getScrapeTimes()
 
-	// Beijing timezone (UTC+8)
-	beijingLoc := time.FixedZone("CST", 8*3600)
+	loc := s.cfg.Location
+	if loc == nil {
+		loc = defaultLocation
+	}
 
 	var lastStr, nextStr string
 	if !last.IsZero() {
-		lastStr = last.In(beijingLoc).Format("2006-01-02 15:04:05")
+		lastStr = last.In(loc).Format("2006-01-02 15:04:05")
 	}
 	if !next.IsZero() {
-		nextStr = next.In(beijingLoc).Format("2006-01-02 15:04:05")
+		nextStr = next.In(loc).Format("2006-01-02 15:04:05")
 	}
 
 	var ps []ProxyStatus
 	for i, p := range proxies {
+		var lastErrAt string
+		if st := stats[p.Addr()]; !st.LastErrorAt.IsZero() {
+			lastErrAt = st.LastErrorAt.In(loc).Format("2006-01-02 15:04:05")
+		}
 		ps = append(ps, ProxyStatus{
-			Addr:    p.Addr(),
-			Country: p.Country,
-			City:    p.City,
-			Active:  i == activeIdx,
+			Index:       i,
+			Addr:        p.Addr(),
+			Country:     p.Country,
+			CountryCode: p.CountryCode,
+			City:        p.City,
+			LatencyMs:   p.Latency.Milliseconds(),
+			SuccessRate: stats[p.Addr()].SuccessRate(),
+			Checks:      stats[p.Addr()].Checks,
+			Anonymity:   string(p.Anonymity),
+			Tags:        p.Tags,
+			Conns:       inUse[p.Addr()],
+			Breaker:     breakerState(breakers, p.Addr()),
+			VerifiedAt:  p.VerifiedAt.In(loc).Format("2006-01-02 15:04:05"),
+			LastError:   stats[p.Addr()].LastError,
+			LastErrorAt: lastErrAt,
+			Pinned:      pinned[p.Addr()],
+			Active:      i == activeIdx,
 		})
 	}
 
@@ -82,31 +281,159 @@ func (s *StatusServer) getStatusData() StatusData {
 		activeRegion = "-"
 	}
 
+	served, up, down := s.server.Traffic()
+
 	return StatusData{
-		Total:        len(proxies),
-		ActiveProxy:  activeProxy,
-		ActiveRegion: activeRegion,
-		LastScrape:   lastStr,
-		NextScrape:   nextStr,
-		Proxies:      ps,
+		Total:          len(proxies),
+		ActiveProxy:    activeProxy,
+		ActiveRegion:   activeRegion,
+		LastScrape:     lastStr,
+		NextScrape:     nextStr,
+		Timezone:       loc.String(),
+		CheckHost:      checkHost(s.cfg.CheckTarget),
+		ActiveConns:    s.server.ActiveConns(),
+		MaxConns:       s.server.MaxConns(),
+		TotalConns:     served,
+		BytesUp:        up,
+		BytesDown:      down,
+		LatencyBuckets: latencyHistogram(proxies),
+		Proxies:        ps,
+	}
+}
+
+// checkHost is the -check-url host for display, with the port only if
+// it isn't HTTP's default.
+func checkHost(target string) string {
+	if host, port, err := net.SplitHostPort(target); err == nil && port == "80" {
+		return host
 	}
+	return target
 }
 
+// breakerState looks addr up in a Breakers result, which omits closed ones.
+func breakerState(breakers map[string]string, addr string) string {
+	if st, ok := breakers[addr]; ok {
+		return st
+	}
+	return BreakerClosed
+}
+
+// handleAPI serves the status JSON. Optional filters narrow Proxies:
+// country matches the ISO code or name case-insensitively, and alive
+// is accepted for clients that expect it, though every pooled proxy
+// has passed its checks (alive=false yields an empty list).
 func (s *StatusServer) handleAPI(w http.ResponseWriter, r *http.Request) {
+	data := s.getStatusData()
+	q := r.URL.Query()
+	if country := q.Get("country"); country != "" {
+		var kept []ProxyStatus
+		for _, p := range data.Proxies {
+			if strings.EqualFold(p.CountryCode, country) || strings.EqualFold(p.Country, country) {
+				kept = append(kept, p)
+			}
+		}
+		data.Proxies = kept
+	}
+	if tag := strings.ToLower(q.Get("tag")); tag != "" {
+		var kept []ProxyStatus
+		for _, p := range data.Proxies {
+			if slices.Contains(p.Tags, tag) {
+				kept = append(kept, p)
+			}
+		}
+		data.Proxies = kept
+	}
+	if alive, err := strconv.ParseBool(q.Get("alive")); err == nil && !alive {
+		data.Proxies = nil
+	}
 	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(s.getStatusData())
+	json.NewEncoder(w).Encode(data)
 }
 
+// wsPushInterval re-sends status even without pool changes, so
+// connection counts and scrape times stay current.
+const wsPushInterval = 10 * time.Second
+
+// handleWS pushes StatusData as JSON on connect, on every pool change,
+// and every wsPushInterval until the client goes away.
+func (s *StatusServer) handleWS(w http.ResponseWriter, r *http.Request) {
+	ws, err := upgradeWebSocket(w, r)
+	if err != nil {
+		code := http.StatusBadRequest
+		if errors.Is(err, errCrossOrigin) {
+			code = http.StatusForbidden
+		}
+		http.Error(w, err.Error(), code)
+		return
+	}
+	defer ws.Close()
+
+	changes, cancel := s.pool.Subscribe()
+	defer cancel()
+
+	closed := make(chan struct{})
+	go func() {
+		ws.ReadLoop()
+		close(closed)
+	}()
+
+	ticker := time.NewTicker(wsPushInterval)
+	defer ticker.Stop()
+	for {
+		data, _ := json.Marshal(s.getStatusData())
+		if err := ws.WriteText(data); err != nil {
+			return
+		}
+		select {
+		case <-changes:
+		case <-ticker.C:
+		case <-closed:
+			return
+		}
+	}
+}
+
+// refreshWaitTimeout bounds how long /api/refresh?wait=true blocks.
+const refreshWaitTimeout = 2 * time.Minute
+
+type refreshResponse struct {
+	Status string `json:"status"`
+	Total  int    `json:"total"`
+}
+
+// handleRefresh triggers a refresh. With wait=true it answers only once
+// the refresh has finished, or with 504 after refreshWaitTimeout.
 func (s *StatusServer) handleRefresh(w http.ResponseWriter, r *http.Request) {
-	TriggerRefresh()
+	done := TriggerRefresh()
 	w.Header().Set("Content-Type", "application/json")
-	w.Write([]byte(`{"status":"refresh triggered"}`))
+	if r.URL.Query().Get("wait") != "true" {
+		w.Write([]byte(`{"status":"refresh triggered"}`))
+		return
+	}
+
+	t := time.NewTimer(refreshWaitTimeout)
+	defer t.Stop()
+	select {
+	case <-done:
+		json.NewEncoder(w).Encode(refreshResponse{Status: "refreshed", Total: s.pool.Size()})
+	case <-t.C:
+		w.WriteHeader(http.StatusGatewayTimeout)
+		json.NewEncoder(w).Encode(refreshResponse{Status: "refresh still running", Total: s.pool.Size()})
+	case <-r.Context().Done():
+	}
 }
 
 func (s *StatusServer) handleSwitch(w http.ResponseWriter, r *http.Request) {
 	w.Header().Set("Content-Type", "application/json")
 	indexStr := r.URL.Query().Get("index")
-	if indexStr != "" {
+	if r.URL.Query().Get("mode") == "fastest" {
+		if _, ok := s.pool.SwitchToFastest(); ok {
+			w.Write([]byte(`{"status":"ok"}`))
+		} else {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			w.Write([]byte(`{"status":"no proxies available"}`))
+		}
+	} else if indexStr != "" {
 		index, err := strconv.Atoi(indexStr)
 		if err != nil {
 			w.WriteHeader(http.StatusBadRequest)
@@ -129,19 +456,371 @@ func (s *StatusServer) handleSwitch(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
+// handleProxy serves DELETE /api/proxy?index=N or ?addr=ip:port.
+// With blacklist=1 the proxy is also kept out of future refreshes.
+func (s *StatusServer) handleProxy(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	if r.Method != http.MethodDelete {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		w.Write([]byte(`{"status":"DELETE required"}`))
+		return
+	}
+
+	q := r.URL.Query()
+	index := -1
+	if addr := q.Get("addr"); addr != "" {
+		index = s.pool.IndexOf(addr)
+	} else if idx, err := strconv.Atoi(q.Get("index")); err == nil {
+		index = idx
+	} else {
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte(`{"status":"index or addr required"}`))
+		return
+	}
+
+	blacklist := q.Get("blacklist") == "1" || q.Get("blacklist") == "true"
+	if _, ok := s.pool.Remove(index, blacklist); !ok {
+		w.WriteHeader(http.StatusNotFound)
+		w.Write([]byte(`{"status":"proxy not found"}`))
+		return
+	}
+	w.Write([]byte(`{"status":"ok"}`))
+}
+
+// handleDrain serves POST /api/drain: the SOCKS5 listener stops
+// accepting and /readyz starts failing, while active relays finish.
+func (s *StatusServer) handleDrain(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	if r.Method != http.MethodPost {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		w.Write([]byte(`{"status":"POST required"}`))
+		return
+	}
+	s.server.Drain()
+	fmt.Fprintf(w, `{"status":"draining","active_conns":%d}`, s.server.ActiveConns())
+}
+
+// handlePin serves POST /api/pin?index=N (or ?addr=ip:port) to pin a
+// proxy and make it active, and DELETE with the same to unpin it, or
+// with neither to unpin all.
+func (s *StatusServer) handlePin(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	if r.Method != http.MethodPost && r.Method != http.MethodDelete {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		w.Write([]byte(`{"status":"POST or DELETE required"}`))
+		return
+	}
+	pin := r.Method == http.MethodPost
+
+	q := r.URL.Query()
+	index := -1
+	if addr := q.Get("addr"); addr != "" {
+		index = s.pool.IndexOf(addr)
+	} else if idx, err := strconv.Atoi(q.Get("index")); err == nil {
+		index = idx
+	} else if !pin && q.Get("index") == "" {
+		s.pool.UnpinAll()
+		w.Write([]byte(`{"status":"ok"}`))
+		return
+	} else {
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte(`{"status":"index or addr required"}`))
+		return
+	}
+
+	if _, ok := s.pool.SetPinned(index, pin); !ok {
+		w.WriteHeader(http.StatusNotFound)
+		w.Write([]byte(`{"status":"proxy not found"}`))
+		return
+	}
+	w.Write([]byte(`{"status":"ok"}`))
+}
+
+// listEntry is one proxy in the /api/list JSON export.
+type listEntry struct {
+	Proxy       string   `json:"proxy"` // scheme://ip:port, no credentials
+	Country     string   `json:"country"`
+	CountryCode string   `json:"country_code"`
+	City        string   `json:"city"`
+	LatencyMs   int64    `json:"latency_ms"`
+	SuccessRate float64  `json:"success_rate"`
+	Anonymity   string   `json:"anonymity,omitempty"`
+	Tags        []string `json:"tags,omitempty"`
+}
+
+// handleList exports the pool for other tools: format=txt (default)
+// is one scheme://ip:port per line, json and csv add geo and latency.
+// Upstream credentials are never included.
+func (s *StatusServer) handleList(w http.ResponseWriter, r *http.Request) {
+	proxies := s.pool.All()
+	stats := s.pool.Stats()
+
+	switch format := r.URL.Query().Get("format"); format {
+	case "", "txt":
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		w.Header().Set("Content-Disposition", `attachment; filename="proxies.txt"`)
+		for _, p := range proxies {
+			fmt.Fprintln(w, p.String())
+		}
+	case "json":
+		entries := make([]listEntry, 0, len(proxies))
+		for _, p := range proxies {
+			entries = append(entries, listEntry{
+				Proxy:       p.String(),
+				Country:     p.Country,
+				CountryCode: p.CountryCode,
+				City:        p.City,
+				LatencyMs:   p.Latency.Milliseconds(),
+				SuccessRate: stats[p.Addr()].SuccessRate(),
+				Anonymity:   string(p.Anonymity),
+				Tags:        p.Tags,
+			})
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(entries)
+	case "csv":
+		w.Header().Set("Content-Type", "text/csv; charset=utf-8")
+		w.Header().Set("Content-Disposition", `attachment; filename="proxies.csv"`)
+		cw := csv.NewWriter(w)
+		cw.Write([]string{"proxy", "country", "country_code", "city", "latency_ms", "success_rate", "anonymity", "tags"})
+		for _, p := range proxies {
+			cw.Write([]string{
+				p.String(), p.Country, p.CountryCode, p.City,
+				strconv.FormatInt(p.Latency.Milliseconds(), 10),
+				strconv.FormatFloat(stats[p.Addr()].SuccessRate(), 'f', 3, 64),
+				string(p.Anonymity), strings.Join(p.Tags, " "),
+			})
+		}
+		cw.Flush()
+	default:
+		http.Error(w, "unknown format "+strconv.Quote(format)+", expected txt, json or csv", http.StatusBadRequest)
+	}
+}
+
+type testResponse struct {
+	Status    string `json:"status"`
+	OK        bool   `json:"ok"`
+	Target    string `json:"target"`
+	Proxy     string `json:"proxy,omitempty"`
+	LatencyMs int64  `json:"latency_ms,omitempty"`
+	Error     string `json:"error,omitempty"`
+}
+
+// handleTest serves GET /api/test?target=host:port: a one-off connect
+// through the active proxy, bounded by -dial-timeout. It's a probe, so
+// a failure doesn't count against the proxy.
+func (s *StatusServer) handleTest(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	target := strings.TrimSpace(r.URL.Query().Get("target"))
+	host, port, err := net.SplitHostPort(target)
+	if n, perr := strconv.Atoi(port); err != nil || host == "" || len(host) > 255 || perr != nil || n < 1 || n > 65535 {
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte(`{"status":"invalid target, expected host:port"}`))
+		return
+	}
+
+	px, ok := s.pool.Current()
+	if !ok {
+		w.WriteHeader(http.StatusServiceUnavailable)
+		w.Write([]byte(`{"status":"no proxies available"}`))
+		return
+	}
+
+	resp := testResponse{Target: target, Proxy: px.Addr()}
+	start := time.Now()
+	conn, err := dialVia(r.Context(), px, target, s.cfg.DialTimeout)
+	if err != nil {
+		resp.Status = "connect failed"
+		resp.Error = err.Error()
+		json.NewEncoder(w).Encode(resp)
+		return
+	}
+	conn.Close()
+	resp.Status = "ok"
+	resp.OK = true
+	resp.LatencyMs = time.Since(start).Milliseconds()
+	json.NewEncoder(w).Encode(resp)
+}
+
+type addRequest struct {
+	Scheme string   `json:"scheme"` // socks5 (default), tls-socks5 or http
+	Addr   string   `json:"addr"`
+	User   string   `json:"user"`
+	Pass   string   `json:"pass"`
+	Tags   []string `json:"tags"`
+}
+
+type addResponse struct {
+	Status    string `json:"status"`
+	Alive     bool   `json:"alive"`
+	Addr      string `json:"addr,omitempty"`
+	Country   string `json:"country,omitempty"`
+	City      string `json:"city,omitempty"`
+	LatencyMs int64  `json:"latency_ms,omitempty"`
+}
+
+type recheckResponse struct {
+	addResponse
+	Evicted bool `json:"evicted,omitempty"`
+}
+
+// handleRecheck serves POST /api/recheck?index=N (or ?addr=ip:port):
+// it runs the health check and geo lookup on that proxy now and
+// updates it in the pool. A proxy that fails stays unless evict=1.
+func (s *StatusServer) handleRecheck(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	if r.Method != http.MethodPost {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		w.Write([]byte(`{"status":"POST required"}`))
+		return
+	}
+
+	q := r.URL.Query()
+	index := -1
+	if addr := q.Get("addr"); addr != "" {
+		index = s.pool.IndexOf(addr)
+	} else if idx, err := strconv.Atoi(q.Get("index")); err == nil {
+		index = idx
+	} else {
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte(`{"status":"index or addr required"}`))
+		return
+	}
+	proxies := s.pool.All()
+	if index < 0 || index >= len(proxies) {
+		w.WriteHeader(http.StatusNotFound)
+		w.Write([]byte(`{"status":"proxy not found"}`))
+		return
+	}
+	px := proxies[index]
+
+	latency, err := checkConnectivity(r.Context(), px, s.cfg.CheckTarget, s.cfg.CheckPath, s.cfg.CheckTimeout)
+	if err == nil {
+		// A failed lookup keeps the location found earlier rather than
+		// overwriting it with "Unknown"
+		if geo := lookupGeoInfo(r.Context(), px.IP, s.cfg.CheckTimeout); geo.Status == "success" {
+			setGeo(&px, geo)
+		}
+	}
+	resp := recheckResponse{addResponse: addResponse{Addr: px.Addr(), Country: px.Country, City: px.City}}
+	if err != nil {
+		s.pool.RecordChecks([]Proxy{px}, nil, map[string]error{px.Addr(): err})
+		resp.Status = "proxy failed verification: " + err.Error()
+		if evict := q.Get("evict"); evict == "1" || evict == "true" {
+			s.pool.Reverified([]Proxy{px}, nil)
+			resp.Evicted = true
+		}
+		json.NewEncoder(w).Encode(resp)
+		return
+	}
+	px.Latency = latency
+	px.VerifiedAt = time.Now()
+	s.pool.RecordChecks([]Proxy{px}, []Proxy{px}, nil)
+	s.pool.Reverified([]Proxy{px}, []Proxy{px})
+	resp.Status = "ok"
+	resp.Alive = true
+	resp.LatencyMs = latency.Milliseconds()
+	json.NewEncoder(w).Encode(resp)
+}
+
+// handleAdd verifies a manually supplied proxy and adds it to the pool
+// if it passes the health check. The country filter is not applied:
+// the operator asked for this proxy explicitly.
+func (s *StatusServer) handleAdd(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	if r.Method != http.MethodPost {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		w.Write([]byte(`{"status":"POST required"}`))
+		return
+	}
+
+	var req addRequest
+	if err := json.NewDecoder(io.LimitReader(r.Body, 4096)).Decode(&req); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte(`{"status":"invalid JSON"}`))
+		return
+	}
+	host, port, err := net.SplitHostPort(strings.TrimSpace(req.Addr))
+	if n, perr := strconv.Atoi(port); err != nil || host == "" || perr != nil || n < 1 || n > 65535 {
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte(`{"status":"invalid addr, expected host:port"}`))
+		return
+	}
+
+	scheme, useTLS, ok := proxyScheme(req.Scheme)
+	if !ok {
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte(`{"status":"invalid scheme, expected socks5, tls-socks5 or http"}`))
+		return
+	}
+
+	if !validAuth(req.User, req.Pass) {
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte(`{"status":"user and pass must be at most 255 bytes"}`))
+		return
+	}
+
+	px := Proxy{Scheme: scheme, TLS: useTLS, IP: host, Port: port, User: req.User, Pass: req.Pass, Tags: normalizeTags(req.Tags)}
+	if s.pool.Contains(px.Addr()) {
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte(`{"status":"proxy already in pool"}`))
+		return
+	}
+
+	latency, err := checkConnectivity(r.Context(), px, s.cfg.CheckTarget, s.cfg.CheckPath, s.cfg.CheckTimeout)
+	if err != nil {
+		resp := addResponse{Addr: px.Addr(), Status: "proxy failed verification: " + err.Error()}
+		w.WriteHeader(http.StatusUnprocessableEntity)
+		json.NewEncoder(w).Encode(resp)
+		return
+	}
+	// Only proxies that work spend the shared geo lookup budget
+	geolocate(r.Context(), &px, s.cfg.CheckTimeout)
+	resp := addResponse{Addr: px.Addr(), Country: px.Country, City: px.City}
+	px.Latency = latency
+	px.VerifiedAt = time.Now()
+	if !s.pool.Add(px) {
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte(`{"status":"proxy already in pool"}`))
+		return
+	}
+	resp.Status = "ok"
+	resp.Alive = true
+	resp.LatencyMs = latency.Milliseconds()
+	json.NewEncoder(w).Encode(resp)
+}
+
 func (s *StatusServer) handleDashboard(w http.ResponseWriter, r *http.Request) {
 	data := s.getStatusData()
 	w.Header().Set("Content-Type", "text/html; charset=utf-8")
 	dashboardTmpl.Execute(w, data)
 }
 
-var dashboardTmpl = template.Must(template.New("dashboard").Parse(`<!DOCTYPE html>
+var dashboardFuncs = template.FuncMap{
+	"pct":   func(f float64) float64 { return f * 100 },
+	"bytes": formatBytes,
+}
+
+// formatBytes renders n in binary units, e.g. 1.5 MiB.
+func formatBytes(n int64) string {
+	const unit = 1024
+	if n < unit {
+		return fmt.Sprintf("%d B", n)
+	}
+	div, exp := int64(unit), 0
+	for m := n / unit; m >= unit; m /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f %ciB", float64(n)/float64(div), "KMGTPE"[exp])
+}
+
+var dashboardTmpl = template.Must(template.New("dashboard").Funcs(dashboardFuncs).Parse(`<!DOCTYPE html>
 <html>
 <head>
 <meta charset="utf-8">
 <title>SOCKS5 Pool Status</title>
 <meta name="viewport" content="width=device-width,initial-scale=1">
-<meta http-equiv="refresh" content="30">
 <style>
 *{margin:0;padding:0;box-sizing:border-box}
 body{font-family:system-ui,-apple-system,sans-serif;background:#0f172a;color:#e2e8f0;padding:12px}
@@ -169,6 +848,24 @@ h1{font-size:1.3rem;color:#38bdf8}
 .proxy-card .status{flex-shrink:0;font-size:0.75rem;font-weight:bold}
 .proxy-card .status.in-use{color:#4ade80}
 .proxy-card .status.standby{color:#64748b}
+.proxy-card .right{display:flex;align-items:center;gap:10px;flex-shrink:0}
+.proxy-card .del{background:none;border:none;color:#64748b;cursor:pointer;padding:2px;display:inline-flex}
+.proxy-card .del:hover{color:#f87171}
+.proxy-card .del svg{width:14px;height:14px;fill:currentColor}
+.proxy-card .chk{background:none;border:none;color:#64748b;cursor:pointer;padding:2px;display:inline-flex}
+.proxy-card .chk:hover{color:#38bdf8}
+.proxy-card .chk:disabled{opacity:0.4;cursor:wait}
+.proxy-card .chk svg{width:14px;height:14px;fill:currentColor}
+.proxy-card .pin{background:none;border:none;color:#475569;cursor:pointer;padding:2px;display:inline-flex}
+.proxy-card .pin:hover{color:#fbbf24}
+.proxy-card .pin.on{color:#fbbf24}
+.proxy-card .pin svg{width:14px;height:14px;fill:currentColor}
+.hist{background:#1e293b;border-radius:8px;padding:10px 16px;margin:8px 0}
+.hist-row{display:flex;align-items:center;gap:8px;font-size:0.75rem;color:#94a3b8;margin:3px 0}
+.hist-row .lbl{width:72px;flex-shrink:0;font-family:monospace}
+.hist-row .bar{flex:1;background:#0f172a;border-radius:3px;height:10px}
+.hist-row .bar div{background:#38bdf8;height:100%;border-radius:3px}
+.hist-row .n{width:32px;text-align:right;color:#e2e8f0}
 .note{color:#64748b;font-size:0.75rem;margin-top:10px;text-align:center}
 .empty{text-align:center;padding:40px;color:#64748b}
 .total{color:#94a3b8;font-size:0.85rem}
@@ -183,63 +880,248 @@ h1{font-size:1.3rem;color:#38bdf8}
   <h1>SOCKS5 Proxy Pool</h1>
   <div style="display:flex;align-items:center;gap:12px">
     <a class="gh-link" href="https://github.com/Dreamy-rain/socks5-proxy" target="_blank" rel="noopener"><svg viewBox="0 0 16 16"><path d="M8 0C3.58 0 0 3.58 0 8c0 3.54 2.29 6.53 5.47 7.59.4.07.55-.17.55-.38 0-.19-.01-.82-.01-1.49-2.01.37-2.53-.49-2.69-.94-.09-.23-.48-.94-.82-1.13-.28-.15-.68-.52-.01-.53.63-.01 1.08.58 1.23.82.72 1.21 1.87.87 2.33.66.07-.52.28-.87.51-1.07-1.78-.2-3.64-.89-3.64-3.95 0-.87.31-1.59.82-2.15-.08-.2-.36-1.02.08-2.12 0 0 .67-.21 2.2.82.64-.18 1.32-.27 2-.27.68 0 1.36.09 2 .27 1.53-1.04 2.2-.82 2.2-.82.44 1.1.16 1.92.08 2.12.51.56.82 1.27.82 2.15 0 3.07-1.87 3.75-3.65 3.95.29.25.54.73.54 1.48 0 1.07-.01 1.93-.01 2.2 0 .21.15.46.55.38A8.013 8.013 0 0016 8c0-4.42-3.58-8-8-8z"/></svg></a>
-    <span class="total">{{.Total}} proxies</span>
+    <span class="total" id="traffic" title="{{.TotalConns}} connections relayed">↑ {{bytes .BytesUp}} ↓ {{bytes .BytesDown}}</span>
+    <span class="total" id="total">{{.ActiveConns}}{{if .MaxConns}}/{{.MaxConns}}{{end}} conns · {{.Total}} proxies</span>
   </div>
 </div>
 <div class="current">
   <div class="current-info">
     <span class="badge">IN USE</span>
-    <span class="addr">{{.ActiveProxy}}</span>
-    <span class="region">{{.ActiveRegion}}</span>
+    <span class="addr" id="active-addr">{{.ActiveProxy}}</span>
+    <span class="region" id="active-region">{{.ActiveRegion}}</span>
   </div>
 </div>
 <div class="time-info">
   <div>
-    <div class="time-item">Last: <span>{{if .LastScrape}}{{.LastScrape}}{{else}}N/A{{end}}</span></div>
-    <div class="time-item">Next: <span>{{if .NextScrape}}{{.NextScrape}}{{else}}N/A{{end}}</span></div>
+    <div class="time-item">Last: <span id="last-scrape">{{if .LastScrape}}{{.LastScrape}}{{else}}N/A{{end}}</span></div>
+    <div class="time-item">Next: <span id="next-scrape">{{if .NextScrape}}{{.NextScrape}}{{else}}N/A{{end}}</span></div>
+  </div>
+  <div style="display:flex;gap:8px">
+    <select class="btn" id="country-filter" onchange="render(lastData)"><option value="">All countries</option></select>
+    <select class="btn" id="tag-filter" onchange="render(lastData)"><option value="">All tags</option></select>
+    <button class="btn" onclick="doFastest(this)">Use fastest</button>
+    <button class="btn" id="refresh-btn" onclick="doRefresh(this)">Refresh Pool</button>
   </div>
-  <button class="btn" onclick="doRefresh(this)">Refresh Pool</button>
 </div>
+<div class="hist" id="latency-hist" title="Check latency across the pool">
+{{range .LatencyBuckets}}<div class="hist-row"><span class="lbl">{{.Label}}</span><div class="bar"><div style="width:{{.Percent}}%"></div></div><span class="n">{{.Count}}</span></div>
+{{end}}</div>
+<div id="proxies">
 {{if .Proxies}}
 <div class="list">
 {{range $i, $p := .Proxies}}
-<div class="proxy-card{{if $p.Active}} active{{end}}" onclick="doSwitch({{$i}},this)">
+<div class="proxy-card{{if $p.Active}} active{{end}}"{{if $p.LastError}} title="Last error {{$p.LastErrorAt}}: {{$p.LastError}}"{{end}} onclick="doSwitch({{$p.Index}},this)">
   <div class="left">
     <span class="idx">{{$i}}</span>
     <div>
       <div class="addr">{{$p.Addr}}</div>
-      <div class="loc">{{$p.Country}}{{if $p.City}}, {{$p.City}}{{end}}</div>
+      <div class="loc">{{$p.Country}}{{if $p.City}}, {{$p.City}}{{end}}{{if $p.LatencyMs}} · {{$p.LatencyMs}}ms{{end}}{{if $p.Anonymity}} · {{$p.Anonymity}}{{end}}{{range $p.Tags}} · #{{.}}{{end}}{{if $p.Conns}} · {{$p.Conns}} conns{{end}}{{if ne $p.Breaker "closed"}} · circuit {{$p.Breaker}}{{end}}{{if $p.Checks}} · {{printf "%.0f" (pct $p.SuccessRate)}}% ok of {{$p.Checks}}{{end}}</div>
     </div>
   </div>
-  <span class="status {{if $p.Active}}in-use{{else}}standby{{end}}">{{if $p.Active}}IN USE{{else}}standby{{end}}</span>
+  <div class="right">
+    <span class="status {{if $p.Active}}in-use{{else}}standby{{end}}">{{if $p.Active}}IN USE{{else}}standby{{end}}</span>
+    <button class="chk" title="Re-check now" onclick="event.stopPropagation();doRecheck({{$p.Addr}},this)"><svg viewBox="0 0 16 16"><path d="M8 2a6 6 0 105.7 7.9l-1.9-.6A4 4 0 118 4c1.1 0 2.1.5 2.8 1.2L9 7h5V2l-1.8 1.8A6 6 0 008 2z"/></svg></button>
+    <button class="pin{{if $p.Pinned}} on{{end}}" title="{{if $p.Pinned}}Unpin{{else}}Pin: keep through rotation and refresh{{end}}" onclick="event.stopPropagation();doPin({{$p.Addr}},{{not $p.Pinned}},this)"><svg viewBox="0 0 16 16"><path d="M5 1h6v1l-1 1v4l2 2v1H9v5l-1 1-1-1v-5H4V9l2-2V3L5 2z"/></svg></button>
+    <button class="del" title="Remove and blacklist" onclick="event.stopPropagation();doRemove({{$p.Addr}},this)"><svg viewBox="0 0 16 16"><path d="M6 1h4l1 1h3v2H2V2h3zM3 5h10l-1 10H4z"/></svg></button>
+  </div>
 </div>
 {{end}}
 </div>
 {{else}}
 <p class="empty">No proxies available. Waiting for next scrape cycle...</p>
 {{end}}
-<p class="note">Auto-refresh 30s | Beijing Time (UTC+8) | Click proxy to switch | Google-verified</p>
+</div>
+<p class="note"><span id="live">Live updates</span> | <span id="timezone">{{.Timezone}}</span> | Click proxy to switch | verified via {{.CheckHost}}</p>
 <p class="note">Proxy source: <a href="https://socks5-proxy.github.io/" target="_blank" rel="noopener" style="color:#38bdf8;text-decoration:none">socks5-proxy.github.io</a></p>
 </div>
 <script>
+var CHK = '<svg viewBox="0 0 16 16"><path d="M8 2a6 6 0 105.7 7.9l-1.9-.6A4 4 0 118 4c1.1 0 2.1.5 2.8 1.2L9 7h5V2l-1.8 1.8A6 6 0 008 2z"/></svg>';
+var PIN = '<svg viewBox="0 0 16 16"><path d="M5 1h6v1l-1 1v4l2 2v1H9v5l-1 1-1-1v-5H4V9l2-2V3L5 2z"/></svg>';
+var TRASH = '<svg viewBox="0 0 16 16"><path d="M6 1h4l1 1h3v2H2V2h3zM3 5h10l-1 10H4z"/></svg>';
+function esc(s) {
+  return String(s).replace(/[&<>"']/g, function(c) {
+    return {'&':'&amp;','<':'&lt;','>':'&gt;','"':'&quot;',"'":'&#39;'}[c];
+  });
+}
+function fmtBytes(n) {
+  if (n < 1024) return n + ' B';
+  var units = 'KMGTPE', i = -1;
+  do { n /= 1024; i++; } while (n >= 1024 && i < units.length - 1);
+  return n.toFixed(1) + ' ' + units[i] + 'iB';
+}
+var lastData = null;
+// fillCountries keeps the dropdown in sync with the countries in the pool
+function fillCountries(list) {
+  var sel = document.getElementById('country-filter'), cur = sel.value, seen = {};
+  var opts = '<option value="">All countries</option>';
+  list.forEach(function(p) {
+    var code = p.country_code || p.country;
+    if (!code || seen[code]) return;
+    seen[code] = true;
+    opts += '<option value="' + esc(code) + '">' + esc(p.country || code) + '</option>';
+  });
+  sel.innerHTML = opts;
+  sel.value = seen[cur] ? cur : '';
+}
+// fillTags does the same for tags
+function fillTags(list) {
+  var sel = document.getElementById('tag-filter'), cur = sel.value, seen = {};
+  var opts = '<option value="">All tags</option>';
+  list.forEach(function(p) {
+    (p.tags || []).forEach(function(t) {
+      if (seen[t]) return;
+      seen[t] = true;
+      opts += '<option value="' + esc(t) + '">#' + esc(t) + '</option>';
+    });
+  });
+  sel.innerHTML = opts;
+  sel.value = seen[cur] ? cur : '';
+}
+function render(d) {
+  if (!d) return;
+  lastData = d;
+  document.getElementById('total').textContent =
+    d.active_conns + (d.max_conns ? '/' + d.max_conns : '') + ' conns \u00b7 ' + d.total + ' proxies';
+  document.getElementById('traffic').title = d.total_conns + ' connections relayed';
+  document.getElementById('traffic').textContent =
+    '\u2191 ' + fmtBytes(d.bytes_up) + ' \u2193 ' + fmtBytes(d.bytes_down);
+  document.getElementById('active-addr').textContent = d.active_proxy;
+  document.getElementById('active-region').textContent = d.active_region;
+  document.getElementById('last-scrape').textContent = d.last_scrape || 'N/A';
+  document.getElementById('next-scrape').textContent = d.next_scrape || 'N/A';
+  document.getElementById('timezone').textContent = d.timezone;
+  var hist = '';
+  (d.latency_buckets || []).forEach(function(b) {
+    hist += '<div class="hist-row"><span class="lbl">' + esc(b.label) + '</span>' +
+      '<div class="bar"><div style="width:' + b.percent + '%"></div></div><span class="n">' + b.count + '</span></div>';
+  });
+  document.getElementById('latency-hist').innerHTML = hist;
+  var list = d.proxies || [];
+  fillCountries(list);
+  fillTags(list);
+  var tag = document.getElementById('tag-filter').value;
+  if (tag) list = list.filter(function(p) { return (p.tags || []).indexOf(tag) >= 0; });
+  var want = document.getElementById('country-filter').value;
+  if (want) list = list.filter(function(p) { return (p.country_code || p.country) === want; });
+  if (!list.length) {
+    document.getElementById('proxies').innerHTML =
+      '<p class="empty">No proxies available. Waiting for next scrape cycle...</p>';
+    return;
+  }
+  var html = '<div class="list">';
+  list.forEach(function(p) {
+    var loc = esc(p.country) + (p.city ? ', ' + esc(p.city) : '') +
+      (p.latency_ms ? ' \u00b7 ' + p.latency_ms + 'ms' : '') +
+      (p.anonymity ? ' \u00b7 ' + esc(p.anonymity) : '') +
+      (p.tags || []).map(function(t) { return ' \u00b7 #' + esc(t); }).join('') +
+      (p.conns ? ' \u00b7 ' + p.conns + ' conns' : '') +
+      (p.breaker && p.breaker !== 'closed' ? ' \u00b7 circuit ' + esc(p.breaker) : '') +
+      (p.checks ? ' \u00b7 ' + Math.round(p.success_rate * 100) + '% ok of ' + p.checks : '');
+    html += '<div class="proxy-card' + (p.active ? ' active' : '') + '"' +
+      (p.last_error ? ' title="Last error ' + esc(p.last_error_at) + ': ' + esc(p.last_error) + '"' : '') +
+      ' onclick="doSwitch(' + p.index + ',this)">' +
+      '<div class="left"><span class="idx">' + p.index + '</span><div>' +
+      '<div class="addr">' + esc(p.addr) + '</div><div class="loc">' + loc + '</div></div></div>' +
+      '<div class="right"><span class="status ' + (p.active ? 'in-use">IN USE' : 'standby">standby') + '</span>' +
+      '<button class="chk" title="Re-check now" data-addr="' + esc(p.addr) +
+      '" onclick="event.stopPropagation();doRecheck(this.dataset.addr,this)">' + CHK + '</button>' +
+      '<button class="pin' + (p.pinned ? ' on' : '') + '" title="' +
+      (p.pinned ? 'Unpin' : 'Pin: keep through rotation and refresh') + '" data-addr="' + esc(p.addr) +
+      '" onclick="event.stopPropagation();doPin(this.dataset.addr,' + !p.pinned + ',this)">' + PIN + '</button>' +
+      '<button class="del" title="Remove and blacklist" data-addr="' + esc(p.addr) +
+      '" onclick="event.stopPropagation();doRemove(this.dataset.addr,this)">' + TRASH + '</button></div></div>';
+  });
+  document.getElementById('proxies').innerHTML = html + '</div>';
+}
+function poll() {
+  return fetch('/api/status').then(function(res) { return res.json(); }).then(render).catch(function() {});
+}
+// Live updates over /ws; fall back to polling every 30s if it drops
+var live = false;
+function connect() {
+  var ws;
+  try {
+    ws = new WebSocket((location.protocol === 'https:' ? 'wss://' : 'ws://') + location.host + '/ws');
+  } catch (e) {
+    fallback();
+    return;
+  }
+  ws.onopen = function() { live = true; document.getElementById('live').textContent = 'Live updates'; };
+  ws.onmessage = function(ev) { render(JSON.parse(ev.data)); };
+  ws.onclose = function() {
+    live = false;
+    fallback();
+    setTimeout(connect, 30000);
+  };
+}
+var pollTimer = null;
+function fallback() {
+  document.getElementById('live').textContent = 'Polling 30s';
+  if (pollTimer) return;
+  pollTimer = setInterval(function() {
+    if (live) { clearInterval(pollTimer); pollTimer = null; return; }
+    poll();
+  }, 30000);
+}
 function doSwitch(idx, el) {
   if (el.classList.contains('active')) return;
   el.style.opacity='0.5';
   fetch('/api/switch?index='+idx).then(function(res) {
-    if (res.ok) { location.reload(); }
+    if (res.ok) { if (!live) poll(); }
     else { el.style.opacity='1'; alert('Switch failed'); }
   }).catch(function() { el.style.opacity='1'; });
 }
+function doFastest(btn) {
+  btn.disabled = true;
+  fetch('/api/switch?mode=fastest').then(function(res) {
+    btn.disabled = false;
+    if (res.ok) { if (!live) poll(); }
+    else { alert('Switch failed'); }
+  }).catch(function() { btn.disabled = false; });
+}
+function doRecheck(addr, btn) {
+  btn.disabled = true;
+  fetch('/api/recheck?addr=' + encodeURIComponent(addr), {method: 'POST'}).then(function(res) {
+    return res.json();
+  }).then(function(d) {
+    btn.disabled = false;
+    if (d.alive) {
+      btn.title = 'Re-checked: ' + d.latency_ms + 'ms';
+      if (!live) poll();
+    } else if (confirm(addr + ' failed the re-check. Remove it from the pool?')) {
+      fetch('/api/recheck?addr=' + encodeURIComponent(addr) + '&evict=1', {method: 'POST'}).then(function() { if (!live) poll(); });
+    }
+  }).catch(function() { btn.disabled = false; });
+}
+function doPin(addr, pin, btn) {
+  btn.disabled = true;
+  fetch('/api/pin?addr=' + encodeURIComponent(addr), {method: pin ? 'POST' : 'DELETE'}).then(function(res) {
+    btn.disabled = false;
+    if (res.ok) { if (!live) poll(); }
+    else { alert('Pin failed'); }
+  }).catch(function() { btn.disabled = false; });
+}
+function doRemove(addr, btn) {
+  if (!confirm('Remove ' + addr + ' and keep it out of future refreshes?')) return;
+  btn.disabled = true;
+  fetch('/api/proxy?blacklist=1&addr=' + encodeURIComponent(addr), {method: 'DELETE'}).then(function(res) {
+    if (res.ok) { if (!live) poll(); }
+    else { btn.disabled = false; alert('Remove failed'); }
+  }).catch(function() { btn.disabled = false; });
+}
 function doRefresh(btn) {
   btn.disabled = true;
   btn.textContent = 'Refreshing...';
-  fetch('/api/refresh').then(function() {
-    setTimeout(function() { location.reload(); }, 15000);
-  }).catch(function() {
+  var reset = function() {
     btn.disabled = false;
     btn.textContent = 'Refresh Pool';
-  });
+  };
+  fetch('/api/refresh?wait=true').then(function() {
+    reset();
+    if (!live) poll();
+  }).catch(reset);
 }
+connect();
 </script>
 </body>
 </html>`))
@@ -0,0 +1,62 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestReadyzWaitsForSelfTest(t *testing.T) {
+	cfg := &Config{}
+	pool := NewProxyPool(cfg)
+	server := &Server{pool: pool}
+	s := NewStatusServer(cfg, pool, server)
+
+	readyz := func() int {
+		rec := httptest.NewRecorder()
+		s.handleReadyz(rec, httptest.NewRequest(http.MethodGet, "/readyz", nil))
+		return rec.Code
+	}
+	if code := readyz(); code != http.StatusServiceUnavailable {
+		t.Errorf("empty pool: /readyz = %d; want 503", code)
+	}
+	pool.Update([]Proxy{testProxy("10.0.0.1", 0)}, nil)
+	if code := readyz(); code != http.StatusServiceUnavailable {
+		t.Errorf("before self-test: /readyz = %d; want 503", code)
+	}
+	server.MarkVerified()
+	if code := readyz(); code != http.StatusOK {
+		t.Errorf("after self-test: /readyz = %d; want 200", code)
+	}
+}
+
+func TestSameOriginOnly(t *testing.T) {
+	tests := []struct {
+		name    string
+		method  string
+		headers map[string]string
+		want    int
+	}{
+		{"script", http.MethodPost, nil, http.StatusOK},
+		{"dashboard fetch", http.MethodPost, map[string]string{"Origin": "http://dash.example:8080", "Sec-Fetch-Site": "same-origin"}, http.StatusOK},
+		{"typed url", http.MethodGet, map[string]string{"Sec-Fetch-Site": "none"}, http.StatusOK},
+		{"cross-site form post", http.MethodPost, map[string]string{"Origin": "http://evil.example", "Sec-Fetch-Site": "cross-site"}, http.StatusForbidden},
+		{"cross-site post without fetch metadata", http.MethodDelete, map[string]string{"Origin": "http://evil.example"}, http.StatusForbidden},
+		{"cross-site image get", http.MethodGet, map[string]string{"Sec-Fetch-Site": "cross-site"}, http.StatusForbidden},
+		{"same-site subdomain", http.MethodGet, map[string]string{"Sec-Fetch-Site": "same-site"}, http.StatusForbidden},
+	}
+	h := sameOriginOnly(func(w http.ResponseWriter, r *http.Request) {})
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest(tt.method, "http://dash.example:8080/api/refresh", nil)
+			for k, v := range tt.headers {
+				r.Header.Set(k, v)
+			}
+			rec := httptest.NewRecorder()
+			h(rec, r)
+			if rec.Code != tt.want {
+				t.Errorf("status = %d; want %d", rec.Code, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,114 @@
+package main
+
+import (
+	"fmt"
+	"math/rand"
+	"net"
+	"strings"
+)
+
+// Tags label proxies for different uses (streaming, scraping, ...) so
+// one instance can serve several logical pools. A client scoped to a
+// tag, by -client-tag or else -default-tag, only gets proxies carrying
+// it. Tags are set through /api/add and kept across refreshes.
+
+// normalizeTags lowercases and trims tags, dropping empty and repeated
+// ones.
+func normalizeTags(tags []string) []string {
+	var out []string
+	seen := make(map[string]bool, len(tags))
+	for _, t := range tags {
+		t = strings.ToLower(strings.TrimSpace(t))
+		if t == "" || seen[t] {
+			continue
+		}
+		seen[t] = true
+		out = append(out, t)
+	}
+	return out
+}
+
+// HasTag reports whether p carries tag. Every proxy matches "".
+func (p Proxy) HasTag(tag string) bool {
+	if tag == "" {
+		return true
+	}
+	for _, t := range p.Tags {
+		if t == tag {
+			return true
+		}
+	}
+	return false
+}
+
+// ClientTag scopes clients in Net to proxies tagged Tag.
+type ClientTag struct {
+	Net *net.IPNet
+	Tag string
+}
+
+// parseClientTag parses a -client-tag value: CIDR=tag, or IP=tag for a
+// single address.
+func parseClientTag(v string) (ClientTag, error) {
+	cidr, tag, ok := strings.Cut(v, "=")
+	tag = strings.ToLower(strings.TrimSpace(tag))
+	if !ok || tag == "" {
+		return ClientTag{}, fmt.Errorf("expected CIDR=tag, got %q", v)
+	}
+	cidr = strings.TrimSpace(cidr)
+	if !strings.Contains(cidr, "/") {
+		ip := net.ParseIP(cidr)
+		if ip == nil {
+			return ClientTag{}, fmt.Errorf("invalid IP %q", cidr)
+		}
+		if ip.To4() != nil {
+			cidr += "/32"
+		} else {
+			cidr += "/128"
+		}
+	}
+	_, ipnet, err := net.ParseCIDR(cidr)
+	if err != nil {
+		return ClientTag{}, err
+	}
+	return ClientTag{Net: ipnet, Tag: tag}, nil
+}
+
+// tagFor returns the tag client's connections are scoped to: the first
+// -client-tag network holding it, else -default-tag. "" means any proxy.
+func (s *Server) tagFor(client string) string {
+	if ip := net.ParseIP(client); ip != nil {
+		for _, ct := range s.clientTags {
+			if ct.Net.Contains(ip) {
+				return ct.Tag
+			}
+		}
+	}
+	return s.defaultTag
+}
+
+// Tagged picks a proxy carrying tag that isn't in skip. Sticky mode
+// keeps to the active proxy when it qualifies and otherwise takes the
+// first one that does, so the fastest after a refresh; the other
+// strategies pick at random among those qualifying.
+func (p *ProxyPool) Tagged(tag string, skip map[string]bool) (Proxy, bool) {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	var cands []Proxy
+	for i, px := range p.proxies {
+		if !px.HasTag(tag) || skip[px.Addr()] {
+			continue
+		}
+		if p.strategy == StrategySticky && i == p.current {
+			return px, true
+		}
+		cands = append(cands, px)
+	}
+	switch {
+	case len(cands) == 0:
+		return Proxy{}, false
+	case p.strategy == StrategySticky:
+		return cands[0], true
+	}
+	return cands[rand.Intn(len(cands))], true
+}
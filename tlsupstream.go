@@ -0,0 +1,66 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"net"
+	"strings"
+	"time"
+)
+
+// SchemeTLSSOCKS5 is how lists spell a SOCKS5 proxy that has to be
+// spoken to inside TLS. Such proxies keep Scheme socks5 and set TLS, so
+// everything that only works over SOCKS5 still applies to them.
+const SchemeTLSSOCKS5 = "tls-socks5"
+
+// tlsInsecure skips certificate verification on TLS upstreams, for
+// ones with self-signed certs. Set from -tls-insecure.
+var tlsInsecure bool
+
+// proxyScheme maps a list scheme to a Proxy's Scheme and TLS flag.
+// socks5h, which some lists use, is SOCKS5.
+func proxyScheme(s string) (scheme string, useTLS bool, ok bool) {
+	switch s = strings.ToLower(s); s {
+	case SchemeSOCKS5, "socks5h", "":
+		return SchemeSOCKS5, false, true
+	case SchemeHTTP:
+		return SchemeHTTP, false, true
+	case SchemeTLSSOCKS5:
+		return SchemeSOCKS5, true, true
+	}
+	return "", false, false
+}
+
+// dialProxy opens a connection to px, inside TLS if px wants it.
+func dialProxy(ctx context.Context, px Proxy, timeout time.Duration) (net.Conn, error) {
+	d := net.Dialer{Timeout: timeout}
+	conn, err := d.DialContext(ctx, "tcp", px.Addr())
+	if err != nil {
+		return nil, err
+	}
+	if !px.TLS {
+		return conn, nil
+	}
+	tc, err := startTLS(ctx, conn, px, timeout)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return tc, nil
+}
+
+// startTLS runs a TLS handshake with px over conn, which may already be
+// a tunnel through other proxies. The cert is checked against the
+// proxy's IP unless -tls-insecure. The caller closes conn on error.
+func startTLS(ctx context.Context, conn net.Conn, px Proxy, timeout time.Duration) (net.Conn, error) {
+	tc := tls.Client(conn, &tls.Config{
+		ServerName:         px.IP,
+		InsecureSkipVerify: tlsInsecure,
+	})
+	conn.SetDeadline(time.Now().Add(timeout))
+	if err := tc.HandshakeContext(ctx); err != nil {
+		return nil, err
+	}
+	conn.SetDeadline(time.Time{})
+	return tc, nil
+}
@@ -0,0 +1,202 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"sync/atomic"
+	"time"
+)
+
+// handleUDPAssociate serves a UDP ASSOCIATE request. Datagrams from the
+// client are forwarded to the upstream proxy's own UDP relay, and replies
+// are sent back. The association lives as long as the TCP control conn.
+func (s *Server) handleUDPAssociate(conn net.Conn) {
+	var (
+		ctrl      net.Conn
+		relayAddr *net.UDPAddr
+	)
+	evicted := false
+	tried := make(map[string]bool)
+	for i := 0; i < s.retries; i++ {
+		upstream, ok := s.pickUntried(clientIP(conn), i, evicted, tried)
+		if !ok && i == 0 {
+			warnf("[udp] no proxies available")
+			s.sendReply(conn, replyGeneralFailure)
+			return
+		}
+		if !ok {
+			break
+		}
+		tried[upstream.Addr()] = true
+		if upstream.scheme() != SchemeSOCKS5 {
+			// HTTP CONNECT can't carry UDP; not the proxy's fault
+			s.pool.Release(upstream.Addr())
+			evicted = false
+			continue
+		}
+
+		var err error
+		ctrl, relayAddr, err = associateViaSOCKS5(upstream, s.dialTimeout)
+		if err != nil {
+			warnf("[udp] upstream %s associate failed: %v, switching...", upstream.Addr(), err)
+			s.pool.Release(upstream.Addr())
+			evicted = s.pool.MarkFailure(upstream.Addr(), err)
+			continue
+		}
+		s.pool.MarkSuccess(upstream.Addr())
+		defer s.pool.Release(upstream.Addr())
+		break
+	}
+	if ctrl == nil {
+		s.sendReply(conn, replyGeneralFailure) // after retries
+		return
+	}
+	defer ctrl.Close()
+
+	remote, err := net.DialUDP("udp", nil, relayAddr)
+	if err != nil {
+		warnf("[udp] dial upstream relay %s failed: %v", relayAddr, err)
+		s.sendReply(conn, replyGeneralFailure)
+		return
+	}
+	defer remote.Close()
+
+	// Bind on the interface the client reached us on
+	localIP := conn.LocalAddr().(*net.TCPAddr).IP
+	local, err := net.ListenUDP("udp", &net.UDPAddr{IP: localIP})
+	if err != nil {
+		errorf("[udp] listen failed: %v", err)
+		s.sendReply(conn, replyGeneralFailure)
+		return
+	}
+	defer local.Close()
+
+	bound := local.LocalAddr().(*net.UDPAddr)
+	s.sendReplyAddr(conn, 0x00, bound.IP, bound.Port)
+
+	clientIP := conn.RemoteAddr().(*net.TCPAddr).IP
+	var clientAddr atomic.Pointer[net.UDPAddr]
+
+	// client -> upstream
+	go func() {
+		buf := make([]byte, 64*1024)
+		for {
+			n, from, err := local.ReadFromUDP(buf)
+			if err != nil {
+				return
+			}
+			if !from.IP.Equal(clientIP) {
+				continue
+			}
+			if _, _, err := parseUDPHeader(buf[:n]); err != nil {
+				continue
+			}
+			clientAddr.Store(from)
+			remote.Write(buf[:n])
+		}
+	}()
+
+	// upstream -> client
+	go func() {
+		buf := make([]byte, 64*1024)
+		for {
+			n, err := remote.Read(buf)
+			if err != nil {
+				return
+			}
+			dst := clientAddr.Load()
+			if dst == nil {
+				continue
+			}
+			if _, _, err := parseUDPHeader(buf[:n]); err != nil {
+				continue
+			}
+			local.WriteToUDP(buf[:n], dst)
+		}
+	}()
+
+	// Tear down when either control connection closes
+	go func() {
+		io.Copy(io.Discard, ctrl)
+		conn.Close()
+	}()
+	io.Copy(io.Discard, conn)
+}
+
+// parseUDPHeader parses the SOCKS5 UDP request header
+// (RSV, FRAG, ATYP, DST.ADDR, DST.PORT) and returns the target and the
+// offset of the payload. Fragmented datagrams are rejected.
+func parseUDPHeader(pkt []byte) (string, int, error) {
+	if len(pkt) < 4 {
+		return "", 0, fmt.Errorf("udp header too short")
+	}
+	if pkt[2] != 0x00 {
+		return "", 0, fmt.Errorf("fragmented datagram (frag=%d)", pkt[2])
+	}
+
+	// Same layout as a request from the ATYP byte on
+	target, err := parseTarget(pkt)
+	if err != nil {
+		return "", 0, err
+	}
+
+	var hdrLen int
+	switch pkt[3] {
+	case atypIPv4:
+		hdrLen = 4 + 4 + 2
+	case atypIPv6:
+		hdrLen = 4 + 16 + 2
+	case atypDomain:
+		hdrLen = 4 + 1 + int(pkt[4]) + 2
+	}
+	return target, hdrLen, nil
+}
+
+// associateViaSOCKS5 opens a UDP association on the upstream proxy.
+// It returns the control connection (which must stay open for the
+// association's lifetime) and the upstream's UDP relay address.
+func associateViaSOCKS5(upstream Proxy, timeout time.Duration) (net.Conn, *net.UDPAddr, error) {
+	conn, err := dialProxy(context.Background(), upstream, timeout)
+	if err != nil {
+		return nil, nil, err
+	}
+	conn.SetDeadline(time.Now().Add(timeout))
+
+	if err := socks5Handshake(conn, upstream); err != nil {
+		conn.Close()
+		return nil, nil, err
+	}
+
+	// UDP ASSOCIATE with 0.0.0.0:0: we don't know our source port yet
+	conn.Write([]byte{0x05, cmdUDP, 0x00, atypIPv4, 0, 0, 0, 0, 0, 0})
+
+	reply, err := readSOCKS5Msg(conn)
+	if err != nil {
+		conn.Close()
+		return nil, nil, err
+	}
+	if reply[1] != 0x00 {
+		conn.Close()
+		return nil, nil, &replyError{cmd: "associate", code: reply[1]}
+	}
+
+	bound, err := parseTarget(reply)
+	if err != nil {
+		conn.Close()
+		return nil, nil, err
+	}
+	relayAddr, err := net.ResolveUDPAddr("udp", bound)
+	if err != nil {
+		conn.Close()
+		return nil, nil, err
+	}
+	// An unspecified bound address means "same host as the proxy"
+	if relayAddr.IP == nil || relayAddr.IP.IsUnspecified() {
+		relayAddr.IP = net.ParseIP(upstream.IP)
+	}
+
+	conn.SetDeadline(time.Time{})
+	return conn, relayAddr, nil
+}
@@ -0,0 +1,192 @@
+package main
+
+import (
+	"bufio"
+	"crypto/sha1"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+)
+
+// Minimal RFC 6455 server side, enough to push JSON to the dashboard.
+// Messages from the client are read and discarded; only ping and close
+// are acted on.
+
+const wsGUID = "258EAFA5-E914-47DA-95CA-C5AB0DC85B11"
+
+const (
+	wsOpText  = 0x1
+	wsOpClose = 0x8
+	wsOpPing  = 0x9
+	wsOpPong  = 0xA
+)
+
+// wsMaxControl bounds client frame payloads; the dashboard never sends
+// anything larger than a close or ping.
+const wsMaxControl = 4096
+
+// errCrossOrigin rejects a handshake from a page on another site, which
+// would otherwise read the dashboard with the browser's credentials.
+var errCrossOrigin = errors.New("cross-origin websocket request")
+
+type wsConn struct {
+	conn net.Conn
+	br   *bufio.Reader
+	wmu  sync.Mutex // serializes frame writes
+}
+
+// upgradeWebSocket completes the opening handshake. On error nothing
+// has been hijacked yet and the caller may still write a response.
+func upgradeWebSocket(w http.ResponseWriter, r *http.Request) (*wsConn, error) {
+	if r.Method != http.MethodGet ||
+		!strings.EqualFold(r.Header.Get("Upgrade"), "websocket") ||
+		!headerHasToken(r.Header.Get("Connection"), "upgrade") {
+		return nil, errors.New("not a websocket handshake")
+	}
+	if r.Header.Get("Sec-WebSocket-Version") != "13" {
+		return nil, errors.New("unsupported websocket version")
+	}
+	if !sameOrigin(r) {
+		return nil, errCrossOrigin
+	}
+	key := r.Header.Get("Sec-WebSocket-Key")
+	if key == "" {
+		return nil, errors.New("missing Sec-WebSocket-Key")
+	}
+	hj, ok := w.(http.Hijacker)
+	if !ok {
+		return nil, errors.New("connection can't be hijacked")
+	}
+	conn, brw, err := hj.Hijack()
+	if err != nil {
+		return nil, err
+	}
+
+	sum := sha1.Sum([]byte(key + wsGUID))
+	resp := "HTTP/1.1 101 Switching Protocols\r\n" +
+		"Upgrade: websocket\r\n" +
+		"Connection: Upgrade\r\n" +
+		"Sec-WebSocket-Accept: " + base64.StdEncoding.EncodeToString(sum[:]) + "\r\n\r\n"
+	if _, err := conn.Write([]byte(resp)); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return &wsConn{conn: conn, br: brw.Reader}, nil
+}
+
+// sameOrigin reports whether r has no Origin, as from non-browser
+// clients, or one whose host matches the Host it was sent to.
+func sameOrigin(r *http.Request) bool {
+	origin := r.Header.Get("Origin")
+	if origin == "" {
+		return true
+	}
+	u, err := url.Parse(origin)
+	if err != nil {
+		return false
+	}
+	return strings.EqualFold(u.Host, r.Host)
+}
+
+func headerHasToken(v, token string) bool {
+	for _, t := range strings.Split(v, ",") {
+		if strings.EqualFold(strings.TrimSpace(t), token) {
+			return true
+		}
+	}
+	return false
+}
+
+// WriteText sends msg as a single unmasked text frame.
+func (c *wsConn) WriteText(msg []byte) error {
+	return c.writeFrame(wsOpText, msg)
+}
+
+func (c *wsConn) writeFrame(op byte, payload []byte) error {
+	c.wmu.Lock()
+	defer c.wmu.Unlock()
+
+	hdr := []byte{0x80 | op, 0}
+	switch n := len(payload); {
+	case n < 126:
+		hdr[1] = byte(n)
+	case n <= 0xFFFF:
+		hdr[1] = 126
+		hdr = binary.BigEndian.AppendUint16(hdr, uint16(n))
+	default:
+		hdr[1] = 127
+		hdr = binary.BigEndian.AppendUint64(hdr, uint64(n))
+	}
+	if _, err := c.conn.Write(hdr); err != nil {
+		return err
+	}
+	_, err := c.conn.Write(payload)
+	return err
+}
+
+// ReadLoop consumes client frames until the connection closes or the
+// client sends a close frame, answering pings along the way.
+func (c *wsConn) ReadLoop() error {
+	hdr := make([]byte, 2)
+	for {
+		if _, err := io.ReadFull(c.br, hdr); err != nil {
+			return err
+		}
+		op := hdr[0] & 0x0F
+		masked := hdr[1]&0x80 != 0
+		n := uint64(hdr[1] & 0x7F)
+		switch n {
+		case 126:
+			ext := make([]byte, 2)
+			if _, err := io.ReadFull(c.br, ext); err != nil {
+				return err
+			}
+			n = uint64(binary.BigEndian.Uint16(ext))
+		case 127:
+			ext := make([]byte, 8)
+			if _, err := io.ReadFull(c.br, ext); err != nil {
+				return err
+			}
+			n = binary.BigEndian.Uint64(ext)
+		}
+		if !masked {
+			return errors.New("unmasked client frame")
+		}
+		if n > wsMaxControl {
+			return fmt.Errorf("client frame too large: %d bytes", n)
+		}
+
+		mask := make([]byte, 4)
+		if _, err := io.ReadFull(c.br, mask); err != nil {
+			return err
+		}
+		payload := make([]byte, n)
+		if _, err := io.ReadFull(c.br, payload); err != nil {
+			return err
+		}
+		for i := range payload {
+			payload[i] ^= mask[i%4]
+		}
+
+		switch op {
+		case wsOpClose:
+			c.writeFrame(wsOpClose, nil)
+			return io.EOF
+		case wsOpPing:
+			if err := c.writeFrame(wsOpPong, payload); err != nil {
+				return err
+			}
+		}
+	}
+}
+
+func (c *wsConn) Close() error {
+	return c.conn.Close()
+}